@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/robertoesteves13/go-template"
+	"github.com/robertoesteves13/go-template/cmd/web/services"
+	"github.com/robertoesteves13/go-template/cmd/web/templates"
+)
+
+// Handler that returns its failures instead of writing them, so the response
+// of every error is decided in one place. See handle.
+type handlerFunc func(w http.ResponseWriter, r *http.Request) error
+
+// Error with the status it must be answered with, for failures that aren't
+// domain errors, such as a malformed form. The message is shown to the user.
+type httpError struct {
+	status int
+	msg    string
+}
+
+func (e *httpError) Error() string {
+	return e.msg
+}
+
+func errorStatus(status int, msg string) error {
+	return &httpError{status: status, msg: msg}
+}
+
+// Adapts a handlerFunc to chi. Errors become an error page, or a problem
+// details document (RFC 9457) for clients that asked for JSON. Unknown errors
+// are logged and answered with a 500 that doesn't leak them.
+func handle(fn handlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ew := &errorWriter{ResponseWriter: w}
+		err := fn(ew, r)
+		if err == nil {
+			return
+		}
+
+		// Part of the response is already out, most likely the client went
+		// away in the middle of it.
+		if ew.wrote {
+			log.Printf("%s %s failed after writing the response: %v", r.Method, r.URL.Path, err)
+			return
+		}
+		writeError(w, r, err)
+	}
+}
+
+// What the user is told about each error.
+func classifyError(err error) (int, string) {
+	var http_err *httpError
+	var validation go_template.ValidationErrors
+	var throttled *services.ThrottledError
+	switch {
+	case errors.As(err, &http_err):
+		return http_err.status, http_err.msg
+	case errors.As(err, &validation):
+		return http.StatusUnprocessableEntity, "Some of the fields are invalid."
+	case errors.Is(err, go_template.ErrNotFound):
+		return http.StatusNotFound, "The page you're looking for doesn't exist."
+	case errors.Is(err, go_template.ErrForbidden):
+		return http.StatusForbidden, "You're not allowed to do that."
+	case errors.Is(err, go_template.ErrInvalidCursor):
+		return http.StatusBadRequest, "The page link is invalid."
+	case errors.Is(err, services.ErrLoginRequired):
+		return http.StatusUnauthorized, "You need to log in to do that."
+	case errors.Is(err, services.ErrPermissionDenied):
+		return http.StatusForbidden, "You're not allowed to do that."
+	case errors.Is(err, services.ErrInvalidCSRFToken):
+		return http.StatusForbidden, "The form expired, reload the page and try again."
+	case errors.As(err, &throttled):
+		return http.StatusTooManyRequests, fmt.Sprintf("Too many failed attempts, try again in %d seconds.", int(math.Ceil(throttled.RetryAfter.Seconds())))
+	}
+
+	return http.StatusInternalServerError, "Something went wrong on our side, try again later."
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	status, detail := classifyError(err)
+	if status >= http.StatusInternalServerError {
+		log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+	}
+
+	renderError(w, r, status, detail, err)
+}
+
+// Answers the errors of the middlewares and routes of the session manager like
+// the ones of the handlers, keeping their status. They already logged the
+// failures on our side.
+func renderSessionError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	known, detail := classifyError(err)
+	if known != status {
+		detail = http.StatusText(status) + "."
+	}
+
+	renderError(w, r, status, detail, err)
+}
+
+func renderError(w http.ResponseWriter, r *http.Request, status int, detail string, err error) {
+	if wantsJSON(r) {
+		writeProblem(w, r, status, detail, err)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), templates.TemplateTitle, http.StatusText(status))
+	w.WriteHeader(status)
+	templates.ErrorPage(status, http.StatusText(status), detail).Render(ctx, w)
+}
+
+// Problem details document, RFC 9457. Validation errors are included as the
+// `errors` extension, keyed by field.
+type problem struct {
+	Type     string            `json:"type"`
+	Title    string            `json:"title"`
+	Status   int               `json:"status"`
+	Detail   string            `json:"detail,omitempty"`
+	Instance string            `json:"instance,omitempty"`
+	Errors   map[string]string `json:"errors,omitempty"`
+}
+
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, detail string, err error) {
+	p := problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   detail,
+		Instance: r.URL.Path,
+	}
+	var validation go_template.ValidationErrors
+	if errors.As(err, &validation) {
+		p.Errors = validation
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// Browsers always accept HTML, htmx and API clients usually don't say
+// anything, so only an explicit JSON without HTML counts.
+func wantsJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return !strings.Contains(accept, "text/html") &&
+		(strings.Contains(accept, "application/json") || strings.Contains(accept, "application/problem+json"))
+}
+
+// Remembers whether the handler started the response, after which an error
+// page can't be sent anymore.
+type errorWriter struct {
+	http.ResponseWriter
+	wrote bool
+}
+
+func (ew *errorWriter) WriteHeader(status int) {
+	ew.wrote = true
+	ew.ResponseWriter.WriteHeader(status)
+}
+
+func (ew *errorWriter) Write(b []byte) (int, error) {
+	ew.wrote = true
+	return ew.ResponseWriter.Write(b)
+}
+
+func (ew *errorWriter) Unwrap() http.ResponseWriter {
+	return ew.ResponseWriter
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	model "github.com/robertoesteves13/go-template"
+	"github.com/robertoesteves13/go-template/cmd/web/services"
+)
+
+func TestSessionErrorsAreRendered(t *testing.T) {
+	sm := services.NewSessionManager(services.NewMemoryStore(), func(u model.User) string {
+		return u.Id.String()
+	}, services.WithErrorRenderer(renderSessionError))
+
+	r := chi.NewRouter()
+	r.Use(sm.Authenticate, sm.CSRF)
+	r.With(sm.RequireAuth).Get("/api/posts", func(w http.ResponseWriter, r *http.Request) {})
+	r.Post("/posts", func(w http.ResponseWriter, r *http.Request) {})
+
+	t.Run("problem details", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/posts", nil)
+		req.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		if w.Code != http.StatusUnauthorized || w.Header().Get("Content-Type") != "application/problem+json" {
+			t.Fatalf("got status %d with %s", w.Code, w.Header().Get("Content-Type"))
+		}
+		var p problem
+		err := json.NewDecoder(w.Body).Decode(&p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Status != http.StatusUnauthorized || p.Detail != "You need to log in to do that." || p.Instance != "/api/posts" {
+			t.Errorf("got problem %+v", p)
+		}
+	})
+
+	t.Run("error page", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/posts", strings.NewReader("title=hi"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Accept", "text/html")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "The form expired") {
+			t.Errorf("got status %d with body %s", w.Code, w.Body)
+		}
+	})
+}
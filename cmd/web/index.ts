@@ -5,3 +5,29 @@ window.Alpine = Alpine;
 window.htmx = htmx;
  
 Alpine.start();
+
+// Flashes of htmx requests come on the `HX-Trigger` header, see flash.go.
+// Same colors as flash.templ.
+const flashColors: Record<string, string> = {
+  success: 'green-200',
+  warning: 'yellow-200',
+  error: 'red-200',
+  info: 'blue-200',
+};
+
+document.addEventListener('flash', (event) => {
+  const container = document.getElementById('flashes');
+  const flashes = (event as CustomEvent).detail?.value;
+  if (!container || !Array.isArray(flashes)) {
+    return;
+  }
+
+  for (const flash of flashes) {
+    const div = document.createElement('div');
+    div.setAttribute('role', flash.level === 'error' ? 'alert' : 'status');
+    div.setAttribute('p', '2');
+    div.setAttribute('bg', flashColors[flash.level] ?? flashColors.info);
+    div.textContent = flash.message;
+    container.append(div);
+  }
+});
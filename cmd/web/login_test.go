@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	model "github.com/robertoesteves13/go-template"
+	"github.com/robertoesteves13/go-template/cmd/web/services"
+)
+
+// Code of the authenticator app for the pending enrollment of u.
+func enrollmentCode(t *testing.T, two_factor *model.TwoFactor, u *model.User, now time.Time) string {
+	t.Helper()
+
+	uri, err := two_factor.EnrollmentURI(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(parsed.Query().Get("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(now.Unix()/30))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%06d", value%1_000_000)
+}
+
+func formRequest(target string, form url.Values) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+func TestSecondFactorFailuresAreThrottled(t *testing.T) {
+	ctx := context.Background()
+	hasher, err := model.NewArgon2idHasher(64, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users := model.NewMemoryUserRepository()
+	user, err := model.NewUser("alice", "alice@example.com", "correct horse battery", hasher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = users.Insert(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	two_factor, err := model.NewTwoFactor(users, make([]byte, 32), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = two_factor.BeginEnrollment(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = two_factor.ConfirmEnrollment(ctx, user, enrollmentCode(t, two_factor, user, time.Now()), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	throttle := services.NewLoginThrottle(services.NewMemoryThrottleStore())
+	attempts := model.NewMemoryLoginAttemptRepository()
+	login := validateLogin(users, hasher, throttle, attempts)
+	verify := verifySecondFactor(users, two_factor, throttle, attempts)
+
+	password := url.Values{"email": {user.Email}, "password": {"correct horse battery"}}
+	wrong_code := url.Values{"code": {"not-a-recovery-code"}}
+
+	// Logging in again with the password must not give fresh guesses.
+	for range services.DefaultAccountPolicy.FreeAttempts + 1 {
+		logged, err := login(formRequest("/login", password))
+		if err != nil {
+			t.Fatalf("password login failed: %v", err)
+		}
+
+		ok, err := verify(formRequest("/login/2fa", wrong_code), *logged)
+		if ok || err != nil {
+			t.Fatalf("wrong code got ok=%v err=%v", ok, err)
+		}
+	}
+
+	var throttled *services.ThrottledError
+	_, err = login(formRequest("/login", password))
+	if !errors.As(err, &throttled) {
+		t.Fatalf("password login after wrong codes got %v, want ThrottledError", err)
+	}
+	_, err = verify(formRequest("/login/2fa", wrong_code), *user)
+	if !errors.As(err, &throttled) {
+		t.Fatalf("code after wrong codes got %v, want ThrottledError", err)
+	}
+
+	reasons := map[model.LoginFailure]int{}
+	for _, a := range attempts.Attempts() {
+		if a.Succeeded {
+			t.Errorf("attempt %+v succeeded without a valid code", a)
+		}
+		reasons[a.Reason]++
+	}
+	want := services.DefaultAccountPolicy.FreeAttempts + 1
+	if reasons[model.LoginSecondFactorPending] != want || reasons[model.LoginWrongCode] != want || reasons[model.LoginThrottled] != 2 {
+		t.Errorf("recorded reasons %v", reasons)
+	}
+}
+
+// Holds every request that got past the throttle until released, so they are
+// all in flight at the same time.
+type gatedUsers struct {
+	model.UserRepository
+	arrived chan struct{}
+	release chan struct{}
+}
+
+func (g *gatedUsers) GetByEmail(ctx context.Context, email string) (*model.User, error) {
+	g.arrived <- struct{}{}
+	<-g.release
+	return g.UserRepository.GetByEmail(ctx, email)
+}
+
+func TestConcurrentLoginsAreThrottled(t *testing.T) {
+	ctx := context.Background()
+	hasher, err := model.NewArgon2idHasher(64, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	memory := model.NewMemoryUserRepository()
+	user, err := model.NewUser("alice", "alice@example.com", "correct horse battery", hasher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = memory.Insert(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users := &gatedUsers{UserRepository: memory, arrived: make(chan struct{}), release: make(chan struct{})}
+	throttle := services.NewLoginThrottle(services.NewMemoryThrottleStore())
+	attempts := model.NewMemoryLoginAttemptRepository()
+	login := validateLogin(users, hasher, throttle, attempts)
+
+	const requests = 20
+	results := make(chan error, requests)
+	for range requests {
+		go func() {
+			_, err := login(formRequest("/login", url.Values{"email": {user.Email}, "password": {"wrong password"}}))
+			results <- err
+		}()
+	}
+
+	passed, refused := 0, 0
+	for passed+refused < requests {
+		select {
+		case <-users.arrived:
+			passed++
+		case err := <-results:
+			var throttled *services.ThrottledError
+			if !errors.As(err, &throttled) {
+				t.Errorf("refused login got %v, want ThrottledError", err)
+			}
+			refused++
+		}
+	}
+	close(users.release)
+	for range passed {
+		err := <-results
+		if err != nil {
+			t.Errorf("wrong password got %v", err)
+		}
+	}
+
+	if want := services.DefaultAccountPolicy.FreeAttempts + 1; passed != want {
+		t.Errorf("%d of %d concurrent logins got to the password, want %d", passed, requests, want)
+	}
+}
@@ -1,9 +1,17 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	model "github.com/robertoesteves13/go-template"
 	"github.com/robertoesteves13/go-template/cmd/web/services"
@@ -14,16 +22,56 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate(os.Args[2:]))
+	}
+
+	db_config, err := internal.DatabaseConfigFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to read database config: %v", err)
+		os.Exit(1)
+	}
+	db, err := internal.OpenDatabase(context.Background(), db_config)
+	if err != nil {
+		fmt.Printf("Failed to connect to database: %v", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	// Handy for development, production should run `wserver migrate up` as a
+	// separate step before rolling out a new version.
+	if os.Getenv("AUTO_MIGRATE") == "true" {
+		applied, err := db.MigrateUp(context.Background())
+		if err != nil {
+			fmt.Printf("Failed to migrate database: %v", err)
+			os.Exit(1)
+		}
+		for _, m := range applied {
+			fmt.Printf("Applied migration %d_%s\n", m.Version, m.Name)
+		}
+	}
+
 	r := chi.NewRouter()
 
-	session_manager, err := services.NewSessionManager[model.User](os.Getenv("MEMCACHE_URL"))
+	session_store, err := newSessionStore(db)
 	if err != nil {
-		fmt.Printf("Failed to initialize session manager: %v", err)
+		fmt.Printf("Failed to initialize session store: %v", err)
 		os.Exit(1)
 	}
+	session_options, err := sessionOptions()
+	if err != nil {
+		fmt.Printf("Failed to read session options: %v", err)
+		os.Exit(1)
+	}
+	session_manager := services.NewSessionManager(session_store, func(u model.User) string {
+		return u.Id.String()
+	}, append(session_options, services.WithErrorRenderer(renderSessionError))...)
 
 	asset_handler, err := services.NewAssetHandler(nil)
-	r.Use(middleware.Logger, session_manager.Authenticate)
+	r.Use(middleware.Logger, session_manager.Authenticate, session_manager.CSRF, session_manager.Flashes, services.MethodOverride)
+	if len(db_config.ReplicaURLs) > 0 {
+		r.Use(services.ReadYourWrites(db_config.MaxReplicaLag))
+	}
 
 	if err != nil {
 		fmt.Printf("Failed to initialize asset handler: %v", err)
@@ -31,44 +79,457 @@ func main() {
 	}
 	r.Get("/assets/{filename}", asset_handler.HandleFunc)
 
-	session_manager.LoginRoute(r, func(r *http.Request) (*model.User, error) {
+	markdown := services.NewMarkdownRenderer(services.WithSyntaxHighlighting("github"))
+	r.Get("/assets/highlight.css", markdown.StylesheetHandler)
+
+	posts := model.NewPostgresPostRepository(db.Queries())
+	users := model.NewPostgresUserRepository(db.Queries())
+
+	hasher, err := newPasswordHasher()
+	if err != nil {
+		fmt.Printf("Failed to initialize password hasher: %v", err)
+		os.Exit(1)
+	}
+	throttle, err := newLoginThrottle(db)
+	if err != nil {
+		fmt.Printf("Failed to initialize login throttle: %v", err)
+		os.Exit(1)
+	}
+	oidc, err := newOIDCRegistry(context.Background(), baseURL())
+	if err != nil {
+		fmt.Printf("Failed to initialize OIDC providers: %v", err)
+		os.Exit(1)
+	}
+	totp_key, err := totpKey()
+	if err != nil {
+		fmt.Printf("Failed to read TOTP key: %v", err)
+		os.Exit(1)
+	}
+	two_factor, err := model.NewTwoFactor(users, totp_key, "go-template")
+	if err != nil {
+		fmt.Printf("Failed to initialize two-factor authentication: %v", err)
+		os.Exit(1)
+	}
+
+	verification_secret, err := verificationSecret()
+	if err != nil {
+		fmt.Printf("Failed to read verification secret: %v", err)
+		os.Exit(1)
+	}
+
+	h := &handlers{
+		posts:    posts,
+		users:    users,
+		sessions: session_manager,
+		markdown: markdown,
+		mailer:   newMailer(),
+		verifier: model.NewEmailVerifier(verification_secret, verificationTTL),
+		resets:   model.NewPostgresPasswordResetRepository(db.Queries()),
+		tx:       model.NewPostgresTransactor(db),
+		totp:     two_factor,
+		hasher:   hasher,
+		oidc:     oidc,
+		baseURL:  baseURL(),
+
+		resetsByIP:    services.NewRateLimiter(10, time.Hour),
+		resetsByEmail: services.NewRateLimiter(3, time.Hour),
+	}
+
+	login_attempts := model.NewPostgresLoginAttemptRepository(db.Queries())
+	session_manager.LoginRoute(r, validateLogin(users, hasher, throttle, login_attempts), h.loginFailed)
+	session_manager.SecondFactorRoute(r, verifySecondFactor(users, two_factor, throttle, login_attempts))
+	session_manager.OIDCRoute(r, oidc, resolveIdentity(h.tx))
+	session_manager.LogoutRoute(r)
+	RegisterRoutes(r, h)
+
+	err = http.ListenAndServe(":3000", r)
+	if err != nil {
+		fmt.Printf("Failed to start server: %v", err)
+		os.Exit(1)
+	}
+}
+
+// Checks the credentials sent to `POST /login`. Every attempt is counted as a
+// failure before the password is hashed, so throttled clients are refused
+// without costing a hash, even when they send many at once, and it's only given
+// back when the password is right. For users with two-factor authentication
+// the password alone doesn't reset the failures of the account, only
+// verifySecondFactor does once the code is right.
+func validateLogin(users model.UserRepository, hasher model.PasswordHasher, throttle *services.LoginThrottle, attempts model.LoginAttemptRepository) func(*http.Request) (*model.User, error) {
+	return func(r *http.Request) (*model.User, error) {
 		err := r.ParseForm()
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse form")
 		}
 		email := r.Form.Get("email")
 		pw := r.Form.Get("password")
+		ip := services.ClientIP(r)
+
+		attempt := &model.LoginAttempt{Email: email, IP: ip, At: time.Now()}
+		defer func() {
+			err := attempts.Record(context.WithoutCancel(r.Context()), attempt)
+			if err != nil {
+				log.Printf("%v", err)
+			}
+		}()
 
-		conn, err := internal.GetConnection(r.Context())
+		err = throttle.Attempt(r.Context(), ip, email)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get connection: %v", err)
+			attempt.Reason = model.LoginThrottled
+			return nil, err
 		}
-		defer conn.Release()
 
-		user, err := model.UserFromDB(r.Context(), conn, email)
-		if err != nil {
+		user, err := users.GetByEmail(r.Context(), email)
+		if errors.Is(err, model.ErrNotFound) {
+			attempt.Reason = model.LoginUnknownEmail
+			return nil, nil
+		} else if err != nil {
 			return nil, fmt.Errorf("failed to get user from db: %v", err)
 		}
-		is_same_password := user.ValidatePassword(pw)
+		attempt.User = user.Id
+
+		is_same_password, err := user.ValidatePassword(r.Context(), users, hasher, pw)
+		if err != nil {
+			log.Printf("%v", err)
+		}
+		if !is_same_password {
+			attempt.Reason = model.LoginWrongPassword
+			return nil, nil
+		}
 
-		if email == user.Email && is_same_password {
+		if user.RequiresSecondFactor() {
+			attempt.Reason = model.LoginSecondFactorPending
+			err = throttle.Release(r.Context(), ip, email)
+			if err != nil {
+				log.Printf("%v", err)
+			}
 			return user, nil
+		}
+
+		attempt.Succeeded = true
+		err = throttle.Succeeded(r.Context(), ip, email)
+		if err != nil {
+			log.Printf("%v", err)
+		}
+
+		return user, nil
+	}
+}
+
+// Finds the user of an ID token accepted by `/login/oidc/{provider}/callback`.
+// Logins that can't be linked to an user are refused.
+func resolveIdentity(tx model.Transactor) func(*http.Request, string, *services.IDTokenClaims) (*model.User, error) {
+	return func(r *http.Request, provider string, claims *services.IDTokenClaims) (*model.User, error) {
+		user, err := model.LoginWithIdentity(r.Context(), tx, model.ExternalIdentity{
+			Provider:      provider,
+			Subject:       claims.Subject,
+			Email:         claims.Email,
+			EmailVerified: bool(claims.EmailVerified),
+			Name:          claims.Name,
+		}, time.Now())
+		if errors.Is(err, model.ErrIdentityConflict) || errors.Is(err, model.ErrMissingEmail) || errors.Is(err, model.ErrUnverifiedEmail) {
+			log.Printf("refused %s login of %s: %v", provider, claims.Subject, err)
+			return nil, nil
+		}
+
+		return user, err
+	}
+}
+
+// Reads the providers listed on `OIDC_PROVIDERS`, e.g. `google,gitlab`. Each
+// one is configured by `OIDC_<NAME>_ISSUER`, `OIDC_<NAME>_CLIENT_ID`,
+// `OIDC_<NAME>_CLIENT_SECRET` and optionally `OIDC_<NAME>_SCOPES` (space
+// separated). Their redirect URL is `<BASE_URL>/login/oidc/<name>/callback`.
+func newOIDCRegistry(ctx context.Context, base_url string) (*services.OIDCRegistry, error) {
+	registry := services.NewOIDCRegistry()
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.TrimSpace(strings.ToLower(name))
+		if name == "" {
+			continue
+		}
+
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		cfg := services.OIDCConfig{
+			Issuer:       os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  base_url + "/login/oidc/" + name + "/callback",
+			Scopes:       strings.Fields(os.Getenv(prefix + "SCOPES")),
+		}
+		if cfg.Issuer == "" || cfg.ClientID == "" {
+			return nil, fmt.Errorf("`%sISSUER` and `%sCLIENT_ID` are required", prefix, prefix)
+		}
+
+		provider, err := services.NewOIDCProvider(ctx, name, cfg)
+		if err != nil {
+			return nil, err
+		}
+		registry.Register(provider)
+	}
+
+	return registry, nil
+}
+
+// Checks the code sent to `POST /login/2fa`. The session copy of the user
+// doesn't have the secret, so it's loaded again. Wrong codes count as failed
+// logins of the IP and the account, otherwise logging in again with the
+// password would give a fresh set of guesses every time.
+func verifySecondFactor(users model.UserRepository, two_factor *model.TwoFactor, throttle *services.LoginThrottle, attempts model.LoginAttemptRepository) func(*http.Request, model.User) (bool, error) {
+	return func(r *http.Request, u model.User) (bool, error) {
+		ip := services.ClientIP(r)
+		attempt := &model.LoginAttempt{User: u.Id, Email: u.Email, IP: ip, At: time.Now()}
+		record := func() {
+			err := attempts.Record(context.WithoutCancel(r.Context()), attempt)
+			if err != nil {
+				log.Printf("%v", err)
+			}
+		}
+
+		err := throttle.Attempt(r.Context(), ip, u.Email)
+		if err != nil {
+			attempt.Reason = model.LoginThrottled
+			record()
+			return false, err
+		}
+
+		user, err := users.Get(r.Context(), u.Id)
+		if err != nil {
+			return false, fmt.Errorf("failed to get user from db: %v", err)
+		}
+
+		err = two_factor.Verify(r.Context(), user, r.FormValue("code"), time.Now())
+		if errors.Is(err, model.ErrInvalidCode) {
+			attempt.Reason = model.LoginWrongCode
+			record()
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+
+		attempt.Succeeded = true
+		record()
+		err = throttle.Succeeded(r.Context(), ip, u.Email)
+		if err != nil {
+			log.Printf("%v", err)
+		}
+
+		return true, nil
+	}
+}
+
+// Key that encrypts the TOTP secrets, 32 bytes in hex on `TOTP_KEY`. Without
+// it a random one is used, so users that enable two-factor authentication can
+// only login with recovery codes after a restart.
+func totpKey() ([]byte, error) {
+	if key := os.Getenv("TOTP_KEY"); key != "" {
+		return hex.DecodeString(key)
+	}
+
+	fmt.Println("TOTP_KEY not set, using a random one")
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	return key, err
+}
+
+// Picks the algorithm of new password hashes from `PASSWORD_HASHER`: argon2id
+// (the default) or bcrypt. Hashes made with other algorithms or parameters are
+// replaced when their users login.
+func newPasswordHasher() (model.PasswordHasher, error) {
+	switch os.Getenv("PASSWORD_HASHER") {
+	case "argon2id", "":
+		hasher := model.DefaultArgon2idHasher()
+		vars := []struct {
+			name  string
+			value *uint32
+		}{
+			{"ARGON2_MEMORY", &hasher.Memory},
+			{"ARGON2_ITERATIONS", &hasher.Iterations},
+		}
+		for _, v := range vars {
+			value := os.Getenv(v.name)
+			if value == "" {
+				continue
+			}
+
+			n, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid `%s`: %v", v.name, err)
+			}
+			*v.value = uint32(n)
+		}
+		if value := os.Getenv("ARGON2_PARALLELISM"); value != "" {
+			n, err := strconv.ParseUint(value, 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid `ARGON2_PARALLELISM`: %v", err)
+			}
+			hasher.Parallelism = uint8(n)
+		}
+
+		return model.NewArgon2idHasher(hasher.Memory, hasher.Iterations, hasher.Parallelism)
+	case "bcrypt":
+		cost := 12
+		if value := os.Getenv("BCRYPT_COST"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid `BCRYPT_COST`: %v", err)
+			}
+			cost = n
+		}
+
+		return model.NewBcryptHasher(cost)
+	default:
+		return nil, fmt.Errorf("unknown password hasher `%s`", os.Getenv("PASSWORD_HASHER"))
+	}
+}
+
+// Picks how emails are sent from `MAILER`: smtp, file (appends them to
+// `MAIL_FILE`) or log (the default), which only prints them.
+func newMailer() services.Mailer {
+	switch os.Getenv("MAILER") {
+	case "smtp":
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+
+		return services.NewSMTPMailer(os.Getenv("SMTP_HOST"), port,
+			os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), os.Getenv("MAIL_FROM"))
+	case "file":
+		path := os.Getenv("MAIL_FILE")
+		if path == "" {
+			path = "mail.log"
+		}
+
+		return services.NewFileMailer(path)
+	default:
+		return services.LogMailer{}
+	}
+}
+
+// Key that signs the verification links. Without `VERIFICATION_SECRET` a
+// random one is used, so links sent before a restart stop working.
+func verificationSecret() ([]byte, error) {
+	if secret := os.Getenv("VERIFICATION_SECRET"); secret != "" {
+		return []byte(secret), nil
+	}
+
+	fmt.Println("VERIFICATION_SECRET not set, using a random one")
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	return secret, err
+}
+
+func baseURL() string {
+	if url := os.Getenv("BASE_URL"); url != "" {
+		return strings.TrimSuffix(url, "/")
+	}
+
+	return "http://localhost:3000"
+}
+
+// Picks the session backend from `SESSION_STORE` (memcache, postgres or
+// memory). When it's not set, memcache is used if `MEMCACHE_URL` is present
+// and the in-memory store otherwise.
+func newSessionStore(db *internal.Database) (services.SessionStore, error) {
+	memcache_url := os.Getenv("MEMCACHE_URL")
+	switch os.Getenv("SESSION_STORE") {
+	case "memcache":
+		return services.NewMemcacheStore(strings.Split(memcache_url, ",")...)
+	case "postgres":
+		return services.NewPostgresStore(db.Acquire), nil
+	case "memory":
+		return services.NewMemoryStore(), nil
+	case "":
+		if memcache_url != "" {
+			return services.NewMemcacheStore(strings.Split(memcache_url, ",")...)
+		}
+		return services.NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown session store `%s`", os.Getenv("SESSION_STORE"))
+	}
+}
+
+// Picks the backend of the login throttle from `LOGIN_THROTTLE_STORE`, with the
+// same choices and defaults as `SESSION_STORE`. The lockout of accounts can be
+// changed with `LOGIN_MAX_FAILURES` and `LOGIN_LOCKOUT_DURATION`.
+func newLoginThrottle(db *internal.Database) (*services.LoginThrottle, error) {
+	var store services.ThrottleStore
+	memcache_url := os.Getenv("MEMCACHE_URL")
+	switch os.Getenv("LOGIN_THROTTLE_STORE") {
+	case "memcache":
+		ms, err := services.NewMemcacheThrottleStore(strings.Split(memcache_url, ",")...)
+		if err != nil {
+			return nil, err
+		}
+		store = ms
+	case "postgres":
+		store = services.NewPostgresThrottleStore(db.Acquire)
+	case "memory":
+		store = services.NewMemoryThrottleStore()
+	case "":
+		if memcache_url != "" {
+			ms, err := services.NewMemcacheThrottleStore(strings.Split(memcache_url, ",")...)
+			if err != nil {
+				return nil, err
+			}
+			store = ms
 		} else {
-			return nil, fmt.Errorf("invalid credentials")
+			store = services.NewMemoryThrottleStore()
 		}
-	})
-	RegisterRoutes(r)
+	default:
+		return nil, fmt.Errorf("unknown login throttle store `%s`", os.Getenv("LOGIN_THROTTLE_STORE"))
+	}
 
-	err = internal.ConnectDatabase()
-	if err != nil {
-		fmt.Printf("Failed to connect to database: %v", err)
-		os.Exit(1)
+	policy := services.DefaultAccountPolicy
+	if value := os.Getenv("LOGIN_MAX_FAILURES"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid `LOGIN_MAX_FAILURES`: %v", err)
+		}
+		policy.LockoutAfter = n
+	}
+	if value := os.Getenv("LOGIN_LOCKOUT_DURATION"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid `LOGIN_LOCKOUT_DURATION`: %v", err)
+		}
+		policy.LockoutDuration = d
 	}
-	defer internal.CloseConn()
 
-	err = http.ListenAndServe(":3000", r)
-	if err != nil {
-		fmt.Printf("Failed to start server: %v", err)
-		os.Exit(1)
+	return services.NewLoginThrottle(store, services.WithAccountPolicy(policy)), nil
+}
+
+// Reads the session timeouts and `SESSION_SECRET` from the env. Unset
+// variables keep the defaults of the session manager.
+func sessionOptions() ([]services.SessionOption, error) {
+	vars := []struct {
+		name   string
+		option func(time.Duration) services.SessionOption
+	}{
+		{"SESSION_ABSOLUTE_TIMEOUT", services.WithAbsoluteTimeout},
+		{"SESSION_IDLE_TIMEOUT", services.WithIdleTimeout},
+		{"SESSION_RENEWAL_THRESHOLD", services.WithRenewalThreshold},
 	}
+
+	opts := make([]services.SessionOption, 0, len(vars))
+	for _, v := range vars {
+		value := os.Getenv(v.name)
+		if value == "" {
+			continue
+		}
+
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid `%s`: %v", v.name, err)
+		}
+		opts = append(opts, v.option(d))
+	}
+
+	if secret := os.Getenv("SESSION_SECRET"); secret != "" {
+		opts = append(opts, services.WithSigningKey([]byte(secret)))
+	} else {
+		fmt.Println("SESSION_SECRET not set, using a random one")
+	}
+
+	return opts, nil
 }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/robertoesteves13/go-template/internal"
+)
+
+const migrateUsage = `usage: wserver migrate <command>
+
+commands:
+  up          apply all pending migrations
+  down [n]    revert the last n migrations (default 1)
+  status      list migrations and when they were applied
+`
+
+// Handles `wserver migrate ...`, returning the exit code.
+func runMigrate(args []string) int {
+	if len(args) == 0 {
+		fmt.Print(migrateUsage)
+		return 2
+	}
+
+	ctx := context.Background()
+	cfg, err := internal.DatabaseConfigFromEnv()
+	if err != nil {
+		fmt.Printf("Failed to read database config: %v\n", err)
+		return 1
+	}
+
+	db, err := internal.OpenDatabase(ctx, cfg)
+	if err != nil {
+		fmt.Printf("Failed to connect to database: %v\n", err)
+		return 1
+	}
+	defer db.Close()
+
+	switch args[0] {
+	case "up":
+		applied, err := db.MigrateUp(ctx)
+		for _, m := range applied {
+			fmt.Printf("applied %d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			fmt.Printf("Failed to migrate: %v\n", err)
+			return 1
+		}
+		if len(applied) == 0 {
+			fmt.Println("database is up to date")
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				fmt.Printf("invalid number of steps `%s`\n", args[1])
+				return 2
+			}
+		}
+
+		reverted, err := db.MigrateDown(ctx, steps)
+		for _, m := range reverted {
+			fmt.Printf("reverted %d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			fmt.Printf("Failed to migrate: %v\n", err)
+			return 1
+		}
+	case "status":
+		states, err := db.MigrationStatus(ctx)
+		if err != nil {
+			fmt.Printf("Failed to get migration status: %v\n", err)
+			return 1
+		}
+
+		for _, s := range states {
+			applied := "pending"
+			if !s.AppliedAt.IsZero() {
+				applied = s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d  %-30s %s\n", s.Version, s.Name, applied)
+		}
+	default:
+		fmt.Fprint(os.Stderr, migrateUsage)
+		return 2
+	}
+
+	return 0
+}
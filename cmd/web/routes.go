@@ -2,149 +2,624 @@ package main
 
 import (
 	"context"
-	"io"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"log"
+	"math"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/oklog/ulid/v2"
 	"github.com/robertoesteves13/go-template"
+	"github.com/robertoesteves13/go-template/cmd/web/services"
 	"github.com/robertoesteves13/go-template/cmd/web/templates"
-	"github.com/robertoesteves13/go-template/internal"
-	"github.com/robertoesteves13/go-template/internal/database"
+	"github.com/skip2/go-qrcode"
 )
 
+// Dependencies shared by the handlers. Add new services here instead of using
+// globals, so they're created once in main.
+type handlers struct {
+	posts    go_template.PostRepository
+	users    go_template.UserRepository
+	sessions *services.SessionManager[go_template.User]
+	markdown *services.MarkdownRenderer
+	mailer   services.Mailer
+	verifier *go_template.EmailVerifier
+	resets   go_template.PasswordResetRepository
+	tx       go_template.Transactor
+	totp     *go_template.TwoFactor
+	hasher   go_template.PasswordHasher
+	oidc     *services.OIDCRegistry
+	// Password reset requests, counted per IP and per email.
+	resetsByIP    *services.RateLimiter
+	resetsByEmail *services.RateLimiter
+	// Where the site is reachable, used on the links sent by email.
+	baseURL string
+}
+
 // All your routes should be written here. You could also transform this file
 // into a folder if you feel this got large enough.
-func RegisterRoutes(r chi.Router) {
-	r.Get("/", postsFeed)
-	r.Post("/", postsFeed)
-	r.Get("/post/{id}", postPage)
-	r.Get("/posts/create", postCreate)
+func RegisterRoutes(r chi.Router, h *handlers) {
+	sm := h.sessions
+
+	r.NotFound(handle(func(w http.ResponseWriter, r *http.Request) error {
+		return go_template.ErrNotFound
+	}))
+
+	r.Get("/", handle(h.postsFeed))
+	r.Post("/", handle(h.postsFeed))
+	r.Get("/post/{id}", handle(h.postPage))
+
+	r.Group(func(r chi.Router) {
+		r.Use(sm.RequirePermission(go_template.PermissionPostWrite))
+		r.Get("/posts/create", postCreatePage)
+		r.Post("/posts", handle(h.postCreate))
+	})
+
+	// Only the route checks if the user is logged in, each handler then checks
+	// if the user can change that specific post.
+	r.Group(func(r chi.Router) {
+		r.Use(sm.RequireAuth)
+		r.Get("/post/{id}/edit", handle(h.postEditPage))
+		r.Put("/post/{id}", handle(h.postUpdate))
+		r.Get("/post/{id}/delete", handle(h.postDeletePage))
+		r.Delete("/post/{id}", handle(h.postDelete))
+	})
 
-	r.Get("/login", loginPage)
+	r.Get("/search", handle(h.searchPage))
+
+	r.Get("/user/{id}", handle(h.userPage))
+	r.With(sm.RequireAuth).Get("/user", currentUserPage)
+
+	r.Get("/login", h.loginPage)
+	r.Get("/login/2fa", secondFactorPage)
 	r.Get("/register", registerPage)
-	r.Post("/register", registerUser)
+	r.Post("/register", handle(h.registerUser))
+	r.Get("/verify", handle(h.verifyEmail))
+	r.With(sm.RequireAuth).Post("/verify/resend", handle(h.resendVerification))
+
+	r.Get("/forgot-password", forgotPasswordPage)
+	r.Post("/forgot-password", handle(h.forgotPassword))
+	r.Get("/reset-password", resetPasswordPage)
+	r.Post("/reset-password", handle(h.resetPassword))
+
+	r.Group(func(r chi.Router) {
+		r.Use(sm.RequireAuth)
+		r.Get("/settings/2fa", handle(h.twoFactorPage))
+		r.Post("/settings/2fa/enroll", handle(h.twoFactorEnroll))
+		r.Post("/settings/2fa/confirm", handle(h.twoFactorConfirm))
+		r.Post("/settings/2fa/disable", handle(h.twoFactorDisable))
+	})
+}
+
+func postCreatePage(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithValue(r.Context(), templates.TemplateTitle, "Create Post")
+	templates.PostForm(new(go_template.Post), false, nil).Render(ctx, w)
 }
 
-func postCreate(w http.ResponseWriter, r *http.Request) {
-	conn, err := internal.GetConnection(r.Context())
+func (h *handlers) postCreate(w http.ResponseWriter, r *http.Request) error {
+	err := r.ParseForm()
 	if err != nil {
-		log.Printf("%v", err)
-		http.Error(w, "500 internal server error", http.StatusInternalServerError)
-		return
+		return errorStatus(http.StatusBadRequest, "The form couldn't be read.")
+	}
+
+	post := go_template.NewPost(sessionUser(r), r.FormValue("title"), r.FormValue("subtitle"), r.FormValue("content"))
+	if errs, ok := post.Validate().(go_template.ValidationErrors); ok {
+		ctx := context.WithValue(r.Context(), templates.TemplateTitle, "Create Post")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return templates.PostForm(post, false, errs).Render(ctx, w)
 	}
-	defer conn.Release()
 
-	post := go_template.NewPost()
-	err = post.InsertDB(r.Context(), conn)
+	err = h.posts.Insert(r.Context(), post)
 	if err != nil {
-		log.Printf("%v", err)
-		http.Error(w, "500 internal server error", http.StatusInternalServerError)
-		return
+		return err
 	}
 
-	http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+	services.AddFlash(w, r, services.FlashSuccess, "Post published")
+	http.Redirect(w, r, post.URL(), http.StatusSeeOther)
+	return nil
 }
 
-func postsFeed(w http.ResponseWriter, r *http.Request) {
-	conn, err := internal.GetConnection(r.Context())
+func (h *handlers) postEditPage(w http.ResponseWriter, r *http.Request) error {
+	post, err := h.loadEditablePost(r, (*go_template.Post).CanEdit)
 	if err != nil {
-		log.Printf("%v", err)
-		http.Error(w, "500 internal server error", http.StatusInternalServerError)
-		return
+		return err
 	}
-	defer conn.Release()
 
-	db := database.New(conn)
-	db_posts, err := db.ListPosts(r.Context())
+	ctx := context.WithValue(r.Context(), templates.TemplateTitle, "Edit "+post.Title())
+	return templates.PostForm(post, true, nil).Render(ctx, w)
+}
+
+func (h *handlers) postUpdate(w http.ResponseWriter, r *http.Request) error {
+	post, err := h.loadEditablePost(r, (*go_template.Post).CanEdit)
 	if err != nil {
-		log.Printf("%v", err)
-		http.Error(w, "500 internal server error", http.StatusInternalServerError)
-		return
+		return err
 	}
 
-	posts := go_template.PostFromDBSlice(db_posts)
+	post.SetTitle(r.FormValue("title"))
+	post.SetSubtitle(r.FormValue("subtitle"))
+	post.SetContent(r.FormValue("content"))
+	if errs, ok := post.Validate().(go_template.ValidationErrors); ok {
+		ctx := context.WithValue(r.Context(), templates.TemplateTitle, "Edit "+post.Title())
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return templates.PostForm(post, true, errs).Render(ctx, w)
+	}
 
-	ctx := context.WithValue(r.Context(), templates.TemplateTitle, "Posts")
-	ctx = context.WithValue(ctx, templates.TemplateDescription, "List of all posts of the website")
+	err = h.posts.Update(r.Context(), post)
+	if err != nil {
+		return err
+	}
+
+	services.AddFlash(w, r, services.FlashSuccess, "Post updated")
+	http.Redirect(w, r, post.URL(), http.StatusSeeOther)
+	return nil
+}
+
+func (h *handlers) postDeletePage(w http.ResponseWriter, r *http.Request) error {
+	post, err := h.loadEditablePost(r, (*go_template.Post).CanDelete)
+	if err != nil {
+		return err
+	}
 
-	templates.PostsFeed(posts).Render(ctx, w)
+	ctx := context.WithValue(r.Context(), templates.TemplateTitle, "Delete "+post.Title())
+	return templates.DeletePost(post).Render(ctx, w)
 }
 
-func postPage(w http.ResponseWriter, r *http.Request) {
+func (h *handlers) postDelete(w http.ResponseWriter, r *http.Request) error {
+	post, err := h.loadEditablePost(r, (*go_template.Post).CanDelete)
+	if err != nil {
+		return err
+	}
+
+	err = h.posts.Delete(r.Context(), post)
+	if err != nil {
+		return err
+	}
+
+	services.AddFlash(w, r, services.FlashSuccess, "Post deleted")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+	return nil
+}
+
+// Gets the post from the `id` URL parameter and checks if the logged user is
+// allowed to change it.
+func (h *handlers) loadEditablePost(r *http.Request, allowed func(*go_template.Post, *go_template.User) bool) (*go_template.Post, error) {
 	id, err := ulid.ParseStrict(chi.URLParam(r, "id"))
 	if err != nil {
-		io.WriteString(w, "invalid page")
-		w.WriteHeader(404)
-		return
+		return nil, go_template.ErrNotFound
 	}
 
-	conn, err := internal.GetConnection(r.Context())
+	post, err := h.posts.Get(r.Context(), id)
 	if err != nil {
-		log.Printf("%v", err)
-		http.Error(w, "500 internal server error", http.StatusInternalServerError)
-		return
+		return nil, err
+	}
+
+	if !allowed(post, sessionUser(r)) {
+		return nil, go_template.ErrForbidden
 	}
-	defer conn.Release()
 
-	db := database.New(conn)
-	db_post, err := db.GetPost(r.Context(), pgtype.UUID{Bytes: id, Valid: true})
+	return post, nil
+}
+
+func sessionUser(r *http.Request) *go_template.User {
+	info := services.GetUserSession[go_template.User](r.Context())
+	if info == nil {
+		return nil
+	}
+
+	return &info.User
+}
+
+const feedPageSize = 20
+
+func (h *handlers) postsFeed(w http.ResponseWriter, r *http.Request) error {
+	cursor := r.URL.Query().Get("cursor")
+	feed, err := h.posts.List(r.Context(), cursor, feedPageSize)
 	if err != nil {
-		log.Printf("%v", err)
-		http.Error(w, "500 internal server error", http.StatusInternalServerError)
-		return
+		return err
 	}
 
-	post := go_template.PostFromDB(db_post)
+	// The infinite scroll only needs the next items, not the whole page.
+	if r.Header.Get("HX-Request") != "" && cursor != "" {
+		return templates.PostsFeedPartial(feed).Render(r.Context(), w)
+	}
+
+	ctx := context.WithValue(r.Context(), templates.TemplateTitle, "Posts")
+	ctx = context.WithValue(ctx, templates.TemplateDescription, "List of all posts of the website")
+
+	return templates.PostsFeed(feed).Render(ctx, w)
+}
+
+// Post content is markdown, which is rendered once per version and then
+// served from the renderer cache.
+func (h *handlers) postPage(w http.ResponseWriter, r *http.Request) error {
+	id, err := ulid.ParseStrict(chi.URLParam(r, "id"))
+	if err != nil {
+		return go_template.ErrNotFound
+	}
+
+	post, err := h.posts.Get(r.Context(), id)
+	if err != nil {
+		return err
+	}
 
 	ctx := context.WithValue(r.Context(), templates.TemplateTitle, post.Title())
 	ctx = context.WithValue(ctx, templates.TemplateDescription, post.Subtitle())
 
-	templates.Post(post).Render(ctx, w)
+	content, err := h.markdown.Render(post.Id().String(), post.UpdatedAt(), post.Content())
+	if err != nil {
+		return err
+	}
+
+	return templates.Post(post, content).Render(ctx, w)
+}
+
+const searchLimit = 20
+
+func (h *handlers) searchPage(w http.ResponseWriter, r *http.Request) error {
+	query := r.URL.Query().Get("q")
+
+	results, err := h.posts.Search(r.Context(), query, searchLimit)
+	if err != nil {
+		return err
+	}
+
+	// The search box in the header only wants the list of results.
+	if r.Header.Get("HX-Request") != "" {
+		return templates.SearchResults(query, results).Render(r.Context(), w)
+	}
+
+	ctx := context.WithValue(r.Context(), templates.TemplateTitle, "Search")
+	ctx = context.WithValue(ctx, templates.TemplateDescription, "Search posts of the website")
+
+	return templates.SearchPage(query, results).Render(ctx, w)
+}
+
+func (h *handlers) userPage(w http.ResponseWriter, r *http.Request) error {
+	id, err := ulid.ParseStrict(chi.URLParam(r, "id"))
+	if err != nil {
+		return go_template.ErrNotFound
+	}
+
+	user, err := h.users.Get(r.Context(), id)
+	if err != nil {
+		return err
+	}
+
+	posts, err := h.posts.ListByAuthor(r.Context(), user.Id)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.WithValue(r.Context(), templates.TemplateTitle, user.Name)
+	ctx = context.WithValue(ctx, templates.TemplateDescription, "Posts written by "+user.Name)
+
+	return templates.UserPage(user, posts).Render(ctx, w)
+}
+
+// The header links here, so logged users can reach their own page without
+// knowing their id.
+func currentUserPage(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, sessionUser(r).URL(), http.StatusSeeOther)
 }
 
 func registerPage(w http.ResponseWriter, r *http.Request) {
-	templates.RegisterPage().Render(r.Context(), w)
+	templates.RegisterPage("", "", nil).Render(r.Context(), w)
 }
 
-func registerUser(w http.ResponseWriter, r *http.Request) {
+func (h *handlers) registerUser(w http.ResponseWriter, r *http.Request) error {
 	err := r.ParseForm()
 	if err != nil {
-		http.Error(w, "invalid", http.StatusBadRequest)
-		return
+		return errorStatus(http.StatusBadRequest, "The form couldn't be read.")
 	}
 
 	username := r.FormValue("username")
 	email := r.FormValue("email")
 	password := r.FormValue("password")
 
-	user, err := go_template.NewUser(username, email, password)
+	user, err := go_template.NewUser(username, email, password, h.hasher)
+	if err == nil {
+		err = h.users.Insert(r.Context(), user)
+	}
+	if errs, ok := err.(go_template.ValidationErrors); ok {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return templates.RegisterPage(username, email, errs).Render(r.Context(), w)
+	} else if err != nil {
+		return err
+	}
+
+	// The account works without it, so a failure here only means the user
+	// has to ask for a new link.
+	err = h.sendVerification(r.Context(), user)
 	if err != nil {
 		log.Printf("%v", err)
-		http.Error(w, "500 internal server error", http.StatusInternalServerError)
-		return
 	}
 
-	conn, err := internal.GetConnection(r.Context())
+	services.AddFlash(w, r, services.FlashSuccess, "Account created, check your email to verify it")
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+	return nil
+}
+
+const verificationTTL = 48 * time.Hour
+
+func (h *handlers) sendVerification(ctx context.Context, user *go_template.User) error {
+	link := h.baseURL + "/verify?token=" + url.QueryEscape(h.verifier.Token(user, time.Now()))
+	return h.mailer.Send(ctx, services.Message{
+		To:      user.Email,
+		Subject: "Verify your email",
+		Body: fmt.Sprintf("Hi %s,\n\nOpen the link below to verify your email. It expires in %d hours.\n\n%s\n",
+			user.Name, int(verificationTTL.Hours()), link),
+	})
+}
+
+func (h *handlers) verifyEmail(w http.ResponseWriter, r *http.Request) error {
+	ctx := context.WithValue(r.Context(), templates.TemplateTitle, "Verify email")
+
+	user, err := h.verifier.Verify(r.Context(), h.users, r.URL.Query().Get("token"), time.Now())
+	switch {
+	case errors.Is(err, go_template.ErrInvalidToken):
+		w.WriteHeader(http.StatusBadRequest)
+		return templates.VerifyEmailPage("This verification link is invalid.").Render(ctx, w)
+	case errors.Is(err, go_template.ErrTokenExpired):
+		w.WriteHeader(http.StatusBadRequest)
+		return templates.VerifyEmailPage("This verification link expired, log in to get a new one.").Render(ctx, w)
+	case errors.Is(err, go_template.ErrAlreadyVerified):
+		return templates.VerifyEmailPage("Your email is already verified.").Render(ctx, w)
+	case err != nil:
+		return err
+	}
+
+	// The link may be opened on a browser logged in as someone else, or not
+	// logged at all, in which case the next login picks up the change.
+	if current := sessionUser(r); current != nil && current.Id == user.Id {
+		err = h.sessions.UpdateSessionUser(w, r, *user)
+		if err != nil {
+			log.Printf("failed to update session: %v", err)
+		}
+	}
+
+	return templates.VerifyEmailPage("Your email was verified.").Render(ctx, w)
+}
+
+func (h *handlers) resendVerification(w http.ResponseWriter, r *http.Request) error {
+	// The session may be older than the verification, so the user is loaded
+	// again to know if there's anything left to do.
+	user, err := h.users.Get(r.Context(), sessionUser(r).Id)
 	if err != nil {
-		log.Printf("%v", err)
-		http.Error(w, "500 internal server error", http.StatusInternalServerError)
-		return
+		return err
+	}
+	if user.IsVerified() {
+		err = h.sessions.UpdateSessionUser(w, r, *user)
+		if err != nil {
+			log.Printf("failed to update session: %v", err)
+		}
+		services.AddFlash(w, r, services.FlashInfo, "Your email is already verified")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return nil
 	}
-	defer conn.Release()
 
-	err = user.InsertDB(r.Context(), conn)
+	err = h.sendVerification(r.Context(), user)
 	if err != nil {
-		log.Printf("%v", err)
-		http.Error(w, "500 internal server error", http.StatusInternalServerError)
-		return
+		return err
+	}
+
+	ctx := context.WithValue(r.Context(), templates.TemplateTitle, "Verify email")
+	return templates.VerificationSentPage(user.Email).Render(ctx, w)
+}
+
+func forgotPasswordPage(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithValue(r.Context(), templates.TemplateTitle, "Forgot password")
+	templates.ForgotPasswordPage().Render(ctx, w)
+}
+
+func (h *handlers) forgotPassword(w http.ResponseWriter, r *http.Request) error {
+	if !h.resetsByIP.Allow(services.ClientIP(r)) {
+		return errorStatus(http.StatusTooManyRequests, "Too many requests, try again later.")
+	}
+
+	email := strings.TrimSpace(r.FormValue("email"))
+	ctx := context.WithValue(r.Context(), templates.TemplateTitle, "Forgot password")
+
+	// Over the limit for an email the page looks the same, so the form can't
+	// be used to flood someone's inbox or to find out who is registered.
+	if !h.resetsByEmail.Allow(strings.ToLower(email)) {
+		return templates.ResetLinkSentPage(email).Render(ctx, w)
+	}
+
+	user, token, err := go_template.RequestPasswordReset(r.Context(), h.users, h.resets, email, time.Now())
+	if errors.Is(err, go_template.ErrNotFound) {
+		return templates.ResetLinkSentPage(email).Render(ctx, w)
+	} else if err != nil {
+		return err
+	}
+
+	link := h.baseURL + "/reset-password?token=" + url.QueryEscape(token)
+	msg := services.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nOpen the link below to choose a new password. It expires in %d minutes.\n\n%s\n\nIf you didn't ask for it, you can ignore this email.\n",
+			user.Name, int(go_template.PasswordResetTTL.Minutes()), link),
+	}
+
+	// Sent in the background, otherwise the time the mail server takes would
+	// tell registered emails apart from unknown ones. It outlives the request,
+	// so a failure can only be logged, the user just asks for a new link.
+	send_ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), time.Minute)
+	go func() {
+		defer cancel()
+		err := h.mailer.Send(send_ctx, msg)
+		if err != nil {
+			log.Printf("%v", err)
+		}
+	}()
+
+	return templates.ResetLinkSentPage(email).Render(ctx, w)
+}
+
+// The token is only checked on submit, the form is harmless without it.
+func resetPasswordPage(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithValue(r.Context(), templates.TemplateTitle, "Reset password")
+	templates.ResetPasswordPage(r.URL.Query().Get("token"), nil).Render(ctx, w)
+}
+
+func (h *handlers) resetPassword(w http.ResponseWriter, r *http.Request) error {
+	ctx := context.WithValue(r.Context(), templates.TemplateTitle, "Reset password")
+	token := r.FormValue("token")
+
+	user, err := go_template.ResetPassword(r.Context(), h.tx, h.hasher, token, r.FormValue("password"), time.Now())
+	if errs, ok := err.(go_template.ValidationErrors); ok {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return templates.ResetPasswordPage(token, errs).Render(ctx, w)
+	} else if errors.Is(err, go_template.ErrInvalidToken) {
+		w.WriteHeader(http.StatusBadRequest)
+		return templates.InvalidResetLinkPage().Render(ctx, w)
+	} else if err != nil {
+		return err
+	}
+
+	// Whoever knew the old password may still be logged in somewhere.
+	err = h.sessions.RevokeUserSessions(r.Context(), *user)
+	if err != nil {
+		log.Printf("failed to revoke sessions: %v", err)
+	}
+
+	services.AddFlash(w, r, services.FlashSuccess, "Password changed, log in with the new one")
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+	return nil
+}
+
+func (h *handlers) loginPage(w http.ResponseWriter, r *http.Request) {
+	templates.LoginPage(r.URL.Query().Get("next"), "", "", h.oidc.Names()).Render(r.Context(), w)
+}
+
+// Shows the login form again when `POST /login` fails.
+func (h *handlers) loginFailed(w http.ResponseWriter, r *http.Request, err error) {
+	msg := "Wrong email or password"
+	status := http.StatusForbidden
+	if throttled := (*services.ThrottledError)(nil); errors.As(err, &throttled) {
+		msg = fmt.Sprintf("Too many failed attempts, try again in %d seconds", int(math.Ceil(throttled.RetryAfter.Seconds())))
+		status = http.StatusTooManyRequests
 	}
 
-	http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+	w.WriteHeader(status)
+	templates.LoginPage(r.FormValue("next"), r.FormValue("email"), msg, h.oidc.Names()).Render(r.Context(), w)
 }
 
-func loginPage(w http.ResponseWriter, r *http.Request) {
-	templates.LoginPage().Render(r.Context(), w)
+func secondFactorPage(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithValue(r.Context(), templates.TemplateTitle, "Two-factor authentication")
+	templates.SecondFactorPage(r.URL.Query().Get("next"), r.URL.Query().Has("invalid")).Render(ctx, w)
+}
+
+// The session doesn't carry the TOTP secret, so the settings always work with
+// a fresh copy of the user.
+func (h *handlers) currentUser(r *http.Request) (*go_template.User, error) {
+	return h.users.Get(r.Context(), sessionUser(r).Id)
+}
+
+func (h *handlers) twoFactorPage(w http.ResponseWriter, r *http.Request) error {
+	user, err := h.currentUser(r)
+	if err != nil {
+		return err
+	}
+	return h.renderTwoFactorSettings(w, r, user, r.URL.Query().Has("invalid"))
+}
+
+func (h *handlers) renderTwoFactorSettings(w http.ResponseWriter, r *http.Request, user *go_template.User, invalid bool) error {
+	ctx := context.WithValue(r.Context(), templates.TemplateTitle, "Two-factor authentication")
+
+	uri, err := h.totp.EnrollmentURI(user)
+	if errors.Is(err, go_template.ErrNoEnrollment) {
+		return templates.TwoFactorSettingsPage(user.HasTOTP(), "", "", invalid).Render(ctx, w)
+	} else if err != nil {
+		return err
+	}
+
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		return fmt.Errorf("failed to encode qr code: %v", err)
+	}
+	qr := "data:image/png;base64," + base64.StdEncoding.EncodeToString(png)
+
+	return templates.TwoFactorSettingsPage(false, uri, qr, invalid).Render(ctx, w)
+}
+
+func (h *handlers) twoFactorEnroll(w http.ResponseWriter, r *http.Request) error {
+	user, err := h.currentUser(r)
+	if err != nil {
+		return err
+	}
+	// Starting over would silently turn it off, disabling must be explicit.
+	if user.HasTOTP() {
+		http.Redirect(w, r, "/settings/2fa", http.StatusSeeOther)
+		return nil
+	}
+
+	err = h.totp.BeginEnrollment(r.Context(), user)
+	if err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, "/settings/2fa", http.StatusSeeOther)
+	return nil
+}
+
+func (h *handlers) twoFactorConfirm(w http.ResponseWriter, r *http.Request) error {
+	user, err := h.currentUser(r)
+	if err != nil {
+		return err
+	}
+
+	codes, err := h.totp.ConfirmEnrollment(r.Context(), user, r.FormValue("code"), time.Now())
+	if errors.Is(err, go_template.ErrInvalidCode) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return h.renderTwoFactorSettings(w, r, user, true)
+	} else if errors.Is(err, go_template.ErrNoEnrollment) {
+		http.Redirect(w, r, "/settings/2fa", http.StatusSeeOther)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	err = h.sessions.UpdateSessionUser(w, r, *user)
+	if err != nil {
+		log.Printf("failed to update session: %v", err)
+	}
+
+	services.AddFlash(w, r, services.FlashSuccess, "Two-factor authentication enabled")
+	ctx := context.WithValue(r.Context(), templates.TemplateTitle, "Recovery codes")
+	return templates.RecoveryCodesPage(codes).Render(ctx, w)
+}
+
+// Asks for a code, so a stolen session alone can't turn the protection off.
+func (h *handlers) twoFactorDisable(w http.ResponseWriter, r *http.Request) error {
+	user, err := h.currentUser(r)
+	if err != nil {
+		return err
+	}
+
+	err = h.totp.Verify(r.Context(), user, r.FormValue("code"), time.Now())
+	if errors.Is(err, go_template.ErrInvalidCode) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return h.renderTwoFactorSettings(w, r, user, true)
+	} else if err != nil {
+		return err
+	}
+
+	err = h.totp.Disable(r.Context(), user)
+	if err != nil {
+		return err
+	}
+
+	err = h.sessions.UpdateSessionUser(w, r, *user)
+	if err != nil {
+		log.Printf("failed to update session: %v", err)
+	}
+
+	services.AddFlash(w, r, services.FlashWarning, "Two-factor authentication disabled")
+	http.Redirect(w, r, "/settings/2fa", http.StatusSeeOther)
+	return nil
 }
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	model "github.com/robertoesteves13/go-template"
+	"github.com/robertoesteves13/go-template/cmd/web/services"
+)
+
+// The app of main with the memory repositories.
+type testApp struct {
+	server *httptest.Server
+	users  *model.MemoryUserRepository
+	posts  *model.MemoryPostRepository
+	mailer *services.MemoryMailer
+	hasher model.PasswordHasher
+}
+
+func newTestApp(t *testing.T) *testApp {
+	t.Helper()
+
+	hasher, err := model.NewArgon2idHasher(64, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &testApp{
+		users:  model.NewMemoryUserRepository(),
+		posts:  model.NewMemoryPostRepository(),
+		mailer: services.NewMemoryMailer(),
+		hasher: hasher,
+	}
+	resets := model.NewMemoryPasswordResetRepository()
+
+	sm := services.NewSessionManager(services.NewMemoryStore(), func(u model.User) string {
+		return u.Id.String()
+	}, services.WithErrorRenderer(renderSessionError))
+	h := &handlers{
+		posts:    a.posts,
+		users:    a.users,
+		sessions: sm,
+		markdown: services.NewMarkdownRenderer(),
+		mailer:   a.mailer,
+		verifier: model.NewEmailVerifier([]byte("secret"), verificationTTL),
+		resets:   resets,
+		tx:       model.NewMemoryTransactor(a.users, resets, model.NewMemoryIdentityRepository()),
+		hasher:   hasher,
+		oidc:     services.NewOIDCRegistry(),
+		baseURL:  "http://app.test",
+
+		resetsByIP:    services.NewRateLimiter(10, time.Hour),
+		resetsByEmail: services.NewRateLimiter(3, time.Hour),
+	}
+
+	r := chi.NewRouter()
+	r.Use(sm.Authenticate, sm.CSRF, sm.Flashes, services.MethodOverride)
+	throttle := services.NewLoginThrottle(services.NewMemoryThrottleStore())
+	sm.LoginRoute(r, validateLogin(a.users, hasher, throttle, model.NewMemoryLoginAttemptRepository()), h.loginFailed)
+	sm.LogoutRoute(r)
+	RegisterRoutes(r, h)
+
+	a.server = httptest.NewServer(r)
+	t.Cleanup(a.server.Close)
+
+	return a
+}
+
+func (a *testApp) addUser(t *testing.T, name string, verified bool) *model.User {
+	t.Helper()
+
+	user, err := model.NewUser(name, name+"@example.com", "correct horse battery", a.hasher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.users.Insert(context.Background(), user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verified {
+		err = a.users.MarkVerified(context.Background(), user, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return user
+}
+
+func (a *testApp) addPost(t *testing.T, author *model.User, title string) *model.Post {
+	t.Helper()
+
+	post := model.NewPost(author, title, "", "Content of "+title)
+	err := a.posts.Insert(context.Background(), post)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return post
+}
+
+// Browser of the tests. It keeps the cookies and doesn't follow redirects, so
+// they can be checked.
+type testClient struct {
+	t      *testing.T
+	app    *testApp
+	client *http.Client
+}
+
+func (a *testApp) client(t *testing.T) *testClient {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testClient{t: t, app: a, client: &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}}
+}
+
+func (c *testClient) do(method string, path string, form url.Values) (*http.Response, string) {
+	c.t.Helper()
+
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequest(method, c.app.server.URL+path, body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	req.Header.Set("Accept", "text/html")
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	return res, string(data)
+}
+
+var csrfField = regexp.MustCompile(`name="` + services.CSRFFormField + `" value="([^"]+)"`)
+
+// Sends a form the way the browser does, with the CSRF token of the page it
+// came from.
+func (c *testClient) submit(method string, path string, form url.Values) (*http.Response, string) {
+	c.t.Helper()
+
+	_, page := c.do(http.MethodGet, "/login", nil)
+	match := csrfField.FindStringSubmatch(page)
+	if match == nil {
+		c.t.Fatal("page has no CSRF token")
+	}
+	form.Set(services.CSRFFormField, match[1])
+
+	return c.do(method, path, form)
+}
+
+func (c *testClient) login(email string, password string) *http.Response {
+	c.t.Helper()
+
+	res, _ := c.submit(http.MethodPost, "/login", url.Values{"email": {email}, "password": {password}})
+	return res
+}
+
+func expectRedirect(t *testing.T, res *http.Response, location string) {
+	t.Helper()
+
+	if res.StatusCode != http.StatusSeeOther || res.Header.Get("Location") != location {
+		t.Fatalf("got status %d to `%s`, want a redirect to `%s`", res.StatusCode, res.Header.Get("Location"), location)
+	}
+}
+
+func TestPostsFeed(t *testing.T) {
+	app := newTestApp(t)
+	author := app.addUser(t, "alice", true)
+	for i := range feedPageSize + 5 {
+		app.addPost(t, author, fmt.Sprintf("Post %02d", i))
+	}
+	c := app.client(t)
+
+	res, page := c.do(http.MethodGet, "/", nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d", res.StatusCode)
+	}
+	// Newest first.
+	if !strings.Contains(page, "Post 24") || !strings.Contains(page, "Post 05") || strings.Contains(page, "Post 04") {
+		t.Errorf("first page doesn't have the newest %d posts", feedPageSize)
+	}
+
+	next := regexp.MustCompile(`href="(/\?cursor=[^"]+)">Next<`).FindStringSubmatch(page)
+	if next == nil {
+		t.Fatal("first page has no link to the next one")
+	}
+	res, page = c.do(http.MethodGet, next[1], nil)
+	if res.StatusCode != http.StatusOK || !strings.Contains(page, "Post 04") || !strings.Contains(page, "Post 00") || strings.Contains(page, "Post 05") {
+		t.Errorf("second page got status %d without the oldest posts", res.StatusCode)
+	}
+
+	res, _ = c.do(http.MethodGet, "/?cursor=forged", nil)
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("forged cursor got status %d, want 400", res.StatusCode)
+	}
+}
+
+func TestPostCreateAuthorization(t *testing.T) {
+	app := newTestApp(t)
+	app.addUser(t, "alice", true)
+	app.addUser(t, "bob", false)
+	form := url.Values{"title": {"Hello"}, "content": {"World"}}
+
+	anonymous := app.client(t)
+	res, _ := anonymous.submit(http.MethodPost, "/posts", form)
+	expectRedirect(t, res, "/login?next=%2Fposts")
+
+	// Users that didn't verify their email can't write.
+	unverified := app.client(t)
+	expectRedirect(t, unverified.login("bob@example.com", "correct horse battery"), "/")
+	res, _ = unverified.submit(http.MethodPost, "/posts", form)
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("unverified user got status %d, want 403", res.StatusCode)
+	}
+
+	author := app.client(t)
+	expectRedirect(t, author.login("alice@example.com", "correct horse battery"), "/")
+	res, page := author.submit(http.MethodPost, "/posts", url.Values{"title": {"Hello"}})
+	if res.StatusCode != http.StatusUnprocessableEntity || !strings.Contains(page, "Content is required") {
+		t.Errorf("invalid post got status %d", res.StatusCode)
+	}
+	res, _ = author.submit(http.MethodPost, "/posts", form)
+	if res.StatusCode != http.StatusSeeOther || !strings.HasPrefix(res.Header.Get("Location"), "/post/") {
+		t.Fatalf("got status %d to `%s`, want a redirect to the post", res.StatusCode, res.Header.Get("Location"))
+	}
+
+	res, page = author.do(http.MethodGet, res.Header.Get("Location"), nil)
+	if res.StatusCode != http.StatusOK || !strings.Contains(page, "Hello") {
+		t.Errorf("new post got status %d", res.StatusCode)
+	}
+}
+
+func TestPostEditAuthorization(t *testing.T) {
+	app := newTestApp(t)
+	author := app.addUser(t, "alice", true)
+	app.addUser(t, "bob", true)
+	post := app.addPost(t, author, "Original")
+	form := url.Values{"title": {"Changed"}, "content": {"Changed content"}}
+
+	anonymous := app.client(t)
+	res, _ := anonymous.do(http.MethodGet, post.URL()+"/edit", nil)
+	expectRedirect(t, res, "/login?next="+url.QueryEscape(post.URL()+"/edit"))
+
+	other := app.client(t)
+	expectRedirect(t, other.login("bob@example.com", "correct horse battery"), "/")
+	res, _ = other.do(http.MethodGet, post.URL()+"/edit", nil)
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("edit page of another user got status %d, want 403", res.StatusCode)
+	}
+	res, _ = other.submit(http.MethodPut, post.URL(), form)
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("update by another user got status %d, want 403", res.StatusCode)
+	}
+	res, _ = other.submit(http.MethodDelete, post.URL(), url.Values{})
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("delete by another user got status %d, want 403", res.StatusCode)
+	}
+
+	c := app.client(t)
+	expectRedirect(t, c.login("alice@example.com", "correct horse battery"), "/")
+	res, _ = c.do(http.MethodGet, post.URL()+"/edit", nil)
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("edit page of the author got status %d", res.StatusCode)
+	}
+	res, _ = c.submit(http.MethodPut, post.URL(), form)
+	expectRedirect(t, res, post.URL())
+
+	saved, err := app.posts.Get(context.Background(), post.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Title() != "Changed" {
+		t.Errorf("got title `%s` after the update", saved.Title())
+	}
+}
+
+func TestRegister(t *testing.T) {
+	app := newTestApp(t)
+	app.addUser(t, "alice", true)
+	c := app.client(t)
+
+	res, page := c.submit(http.MethodPost, "/register", url.Values{
+		"username": {"bob"},
+		"email":    {"bob@example.com"},
+		"password": {"short"},
+	})
+	if res.StatusCode != http.StatusUnprocessableEntity || !strings.Contains(page, "bob@example.com") {
+		t.Errorf("weak password got status %d, want the form again", res.StatusCode)
+	}
+
+	res, _ = c.submit(http.MethodPost, "/register", url.Values{
+		"username": {"bob"},
+		"email":    {"bob@example.com"},
+		"password": {"correct horse battery"},
+	})
+	expectRedirect(t, res, "/login")
+
+	user, err := app.users.GetByEmail(context.Background(), "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Name != "bob" || user.IsVerified() {
+		t.Errorf("got user %+v, want an unverified bob", user)
+	}
+	messages := app.mailer.Messages()
+	if len(messages) != 1 || messages[0].To != "bob@example.com" || !strings.Contains(messages[0].Body, "http://app.test/verify?token=") {
+		t.Errorf("got messages %+v, want the verification email", messages)
+	}
+
+	res, _ = c.submit(http.MethodPost, "/register", url.Values{
+		"username": {"alice2"},
+		"email":    {"alice@example.com"},
+		"password": {"correct horse battery"},
+	})
+	if res.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("taken email got status %d, want 422", res.StatusCode)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	app := newTestApp(t)
+	app.addUser(t, "alice", true)
+
+	t.Run("success", func(t *testing.T) {
+		c := app.client(t)
+		res, _ := c.submit(http.MethodPost, "/login", url.Values{
+			"email":    {"alice@example.com"},
+			"password": {"correct horse battery"},
+			"next":     {"/user"},
+		})
+		expectRedirect(t, res, "/user")
+
+		res, _ = c.do(http.MethodGet, "/user", nil)
+		if res.StatusCode != http.StatusSeeOther || !strings.HasPrefix(res.Header.Get("Location"), "/user/") {
+			t.Errorf("got status %d to `%s`, want the page of the user", res.StatusCode, res.Header.Get("Location"))
+		}
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		c := app.client(t)
+		for _, email := range []string{"alice@example.com", "nobody@example.com"} {
+			res, page := c.submit(http.MethodPost, "/login", url.Values{"email": {email}, "password": {"wrong password"}})
+			if res.StatusCode != http.StatusForbidden || !strings.Contains(page, "Wrong email or password") {
+				t.Errorf("wrong login of %s got status %d, want 403", email, res.StatusCode)
+			}
+		}
+
+		res, _ := c.do(http.MethodGet, "/user", nil)
+		expectRedirect(t, res, "/login?next=%2Fuser")
+	})
+
+	t.Run("throttling", func(t *testing.T) {
+		app.addUser(t, "bob", true)
+		c := app.client(t)
+		for range services.DefaultAccountPolicy.FreeAttempts + 1 {
+			c.login("bob@example.com", "wrong password")
+		}
+
+		// Even the right password has to wait.
+		res := c.login("bob@example.com", "correct horse battery")
+		if res.StatusCode != http.StatusTooManyRequests || res.Header.Get("Retry-After") == "" {
+			t.Errorf("got status %d with Retry-After `%s`, want 429", res.StatusCode, res.Header.Get("Retry-After"))
+		}
+	})
+}
+
+// Holds every email until released.
+type blockedMailer struct {
+	sent    chan services.Message
+	release chan struct{}
+}
+
+func (m *blockedMailer) Send(ctx context.Context, msg services.Message) error {
+	<-m.release
+	m.sent <- msg
+	return nil
+}
+
+func TestForgotPasswordDoesNotWaitForTheEmail(t *testing.T) {
+	hasher, err := model.NewArgon2idHasher(64, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := model.NewMemoryUserRepository()
+	user, err := model.NewUser("alice", "alice@example.com", "correct horse battery", hasher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = users.Insert(context.Background(), user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mailer := &blockedMailer{sent: make(chan services.Message, 1), release: make(chan struct{})}
+	h := &handlers{
+		users:   users,
+		resets:  model.NewMemoryPasswordResetRepository(),
+		mailer:  mailer,
+		baseURL: "http://app.test",
+
+		resetsByIP:    services.NewRateLimiter(10, time.Hour),
+		resetsByEmail: services.NewRateLimiter(3, time.Hour),
+	}
+
+	// Registered or not, the page comes back while the email is still held.
+	for _, email := range []string{"alice@example.com", "nobody@example.com"} {
+		w := httptest.NewRecorder()
+		err := h.forgotPassword(w, formRequest("/forgot-password", url.Values{"email": {email}}))
+		if err != nil || !strings.Contains(w.Body.String(), "we sent a link") {
+			t.Errorf("%s got %v with body %s", email, err, w.Body)
+		}
+	}
+
+	close(mailer.release)
+	select {
+	case msg := <-mailer.sent:
+		if msg.To != user.Email || !strings.Contains(msg.Body, "http://app.test/reset-password?token=") {
+			t.Errorf("got message %+v, want the reset link of alice", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the reset email was never sent")
+	}
+}
@@ -0,0 +1,106 @@
+package services
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Sent to the error renderer by RequireAuth and RequirePermission.
+var (
+	ErrLoginRequired    = errors.New("login required")
+	ErrPermissionDenied = errors.New("permission denied")
+)
+
+// Implemented by user types that support permissions. RequirePermission only
+// works if the session's user (or a pointer to it) implements it.
+type PermissionChecker interface {
+	HasPermission(permission string) bool
+}
+
+// Middleware that only lets logged users through. Browsers are redirected to
+// the login page, while API clients get a 401.
+func (sm *SessionManager[User]) RequireAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if GetUserSession[User](r.Context()) == nil {
+			sm.unauthorized(w, r)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Middleware that only lets through logged users with the given permission.
+// Anonymous users are handled the same way as RequireAuth, while users
+// without the permission get a 403.
+func (sm *SessionManager[User]) RequirePermission(permission string) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			info := GetUserSession[User](r.Context())
+			if info == nil {
+				sm.unauthorized(w, r)
+				return
+			}
+
+			if !HasPermission(info.User, permission) {
+				sm.renderError(w, r, http.StatusForbidden, ErrPermissionDenied)
+				return
+			}
+
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Checks the permission of an user that may or may not implement
+// PermissionChecker, either by value or by pointer.
+func HasPermission[User any](u User, permission string) bool {
+	if pc, ok := any(u).(PermissionChecker); ok {
+		return pc.HasPermission(permission)
+	}
+	if pc, ok := any(&u).(PermissionChecker); ok {
+		return pc.HasPermission(permission)
+	}
+
+	return false
+}
+
+func (sm *SessionManager[User]) unauthorized(w http.ResponseWriter, r *http.Request) {
+	if !wantsHTML(r) {
+		sm.renderError(w, r, http.StatusUnauthorized, ErrLoginRequired)
+		return
+	}
+
+	login := "/login?next=" + url.QueryEscape(r.URL.RequestURI())
+	if r.Header.Get("HX-Request") != "" {
+		// htmx would swap the login page inside the current one, so ask it
+		// to do a full redirect instead.
+		w.Header().Set("HX-Redirect", login)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	http.Redirect(w, r, login, http.StatusSeeOther)
+}
+
+// Browsers always send `text/html` in the Accept header, API clients usually
+// ask for JSON or nothing at all.
+func wantsHTML(r *http.Request) bool {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		return false
+	}
+
+	return strings.Contains(r.Header.Get("Accept"), "text/html") || r.Header.Get("HX-Request") != ""
+}
+
+// Only accepts paths in this same site, so `next` can't be used to redirect
+// users to a malicious page after login.
+func safeRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+
+	return next
+}
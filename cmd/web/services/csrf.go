@@ -0,0 +1,109 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+)
+
+const (
+	// Name of the form field that carries the token on regular submissions.
+	CSRFFormField = "csrf_token"
+	// Header that carries the token on htmx and javascript requests.
+	CSRFHeader = "X-CSRF-Token"
+
+	csrfCookie = "csrf"
+)
+
+// Sent to the error renderer when an unsafe request comes without the token of
+// the user, usually a form left open for longer than the session lasted.
+var ErrInvalidCSRFToken = errors.New("invalid csrf token")
+
+// Gets the CSRF token of the current request. It's empty if the CSRF
+// middleware didn't run.
+func GetCSRFToken(ctx context.Context) string {
+	token, _ := ctx.Value(CSRFToken).(string)
+	return token
+}
+
+func newCSRFToken() string {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic("unreachable error on csrf.go: " + err.Error())
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Middleware that protects every unsafe method (POST, PUT, PATCH, DELETE)
+// against cross-site request forgery. It must run after Authenticate.
+//
+// Logged users get a synchronizer token stored in their session. Anonymous
+// users get a random token in a cookie, which still protects forms such as
+// login and register. The token is exposed with GetCSRFToken so templates can
+// embed it in forms and in the headers sent by htmx.
+func (sm *SessionManager[User]) CSRF(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := ""
+		if info := GetUserSession[User](r.Context()); info != nil {
+			token = info.CSRFToken
+		}
+
+		// Sessions created before CSRF protection existed don't have a
+		// token, so they fallback to the anonymous one.
+		if token == "" {
+			if cookie, err := r.Cookie(csrfCookie); err == nil && cookie.Value != "" {
+				token = cookie.Value
+			} else {
+				token = newCSRFToken()
+				http.SetCookie(w, &http.Cookie{
+					Name:     csrfCookie,
+					Value:    token,
+					Path:     "/",
+					HttpOnly: true,
+					SameSite: http.SameSiteStrictMode,
+					// TODO: uncomment when http2 is supported
+					// Secure: true,
+				})
+			}
+		}
+
+		if !isSafeMethod(r.Method) && !validCSRFToken(r, token) {
+			log.Printf("csrf token mismatch on %s %s", r.Method, r.URL.Path)
+			sm.renderError(w, r, http.StatusForbidden, ErrInvalidCSRFToken)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), CSRFToken, token)
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	default:
+		return false
+	}
+}
+
+// htmx requests always send the token through the header, since it's set
+// globally with `hx-headers`. Regular forms use the hidden field.
+func validCSRFToken(r *http.Request, expected string) bool {
+	sent := r.Header.Get(CSRFHeader)
+	if sent == "" && r.Header.Get("HX-Request") == "" {
+		sent = r.PostFormValue(CSRFFormField)
+	}
+
+	if sent == "" || expected == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(sent), []byte(expected)) == 1
+}
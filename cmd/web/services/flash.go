@@ -0,0 +1,305 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type FlashLevel string
+
+const (
+	FlashInfo    FlashLevel = "info"
+	FlashSuccess FlashLevel = "success"
+	FlashWarning FlashLevel = "warning"
+	FlashError   FlashLevel = "error"
+)
+
+// Message shown once on the next page the user sees, usually after a
+// redirect.
+type Flash struct {
+	Level   FlashLevel `json:"level"`
+	Message string     `json:"message"`
+}
+
+const (
+	flashCookie = "flash"
+	// Anonymous flashes are meant for the very next request, a cookie that
+	// lingers is only noise.
+	flashCookieMaxAge = 5 * time.Minute
+	// Name of the htmx event carrying the flashes, see `index.ts`.
+	FlashEvent = "flash"
+)
+
+// Flashes of the request. They're loaded by the Flashes middleware and saved
+// back, or handed to the page, once the handler writes the response.
+type flashState struct {
+	flashes []Flash
+	shown   bool
+}
+
+// Queues a message for the user. It's shown by the page rendered by this
+// request if there's one, otherwise by the next page, so it survives
+// redirects. Logged users keep them in their session, anonymous ones in a
+// signed cookie. Requires the Flashes middleware.
+func AddFlash(w http.ResponseWriter, r *http.Request, level FlashLevel, msg string) {
+	state, ok := r.Context().Value(FlashMessages).(*flashState)
+	if !ok {
+		log.Printf("flash `%s` dropped, the Flashes middleware isn't running", msg)
+		return
+	}
+
+	state.flashes = append(state.flashes, Flash{Level: level, Message: msg})
+}
+
+// Flashes to be shown by the page being rendered. Reading them marks them as
+// shown, so they're cleared instead of kept for the next page.
+func GetFlashes(ctx context.Context) []Flash {
+	state, ok := ctx.Value(FlashMessages).(*flashState)
+	if !ok {
+		return nil
+	}
+
+	state.shown = true
+	return state.flashes
+}
+
+// Middleware that loads the pending flashes and decides what happens to them
+// when the response starts: pages show them, htmx requests get them on the
+// `HX-Trigger` header, and anything else (redirects, assets, JSON) keeps them
+// for later. It must run after Authenticate.
+func (sm *SessionManager[User]) Flashes(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state := &flashState{}
+
+		info := GetUserSession[User](r.Context())
+		from_session := info != nil && len(info.Flashes) > 0
+		if from_session {
+			state.flashes = append(state.flashes, info.Flashes...)
+		}
+		from_cookie := false
+		if cookie, err := r.Cookie(flashCookie); err == nil {
+			flashes, ok := sm.decodeFlashCookie(cookie.Value)
+			if ok {
+				state.flashes = append(state.flashes, flashes...)
+			}
+			from_cookie = true
+		}
+		loaded := len(state.flashes)
+
+		fw := &flashWriter{ResponseWriter: w}
+		fw.before = func(status int) {
+			if len(state.flashes) == 0 {
+				// Forged or made with another key.
+				if from_cookie {
+					sm.clearFlashCookie(w)
+				}
+				return
+			}
+
+			if !state.shown {
+				if status < 300 && r.Header.Get("HX-Request") != "" && displaysFlashes(w.Header()) {
+					setFlashTrigger(w.Header(), state.flashes)
+				} else {
+					// Nothing new, they're still where they were loaded from.
+					// Saves a write on every asset the page loads.
+					if len(state.flashes) > loaded {
+						sm.saveFlashes(w, r, state.flashes, from_cookie)
+					}
+					return
+				}
+			}
+
+			if from_cookie {
+				sm.clearFlashCookie(w)
+			}
+			if from_session {
+				sm.clearSessionFlashes(r)
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), FlashMessages, state)
+		h.ServeHTTP(fw, r.WithContext(ctx))
+		fw.commit()
+	})
+}
+
+// htmx swaps HTML fragments, a redirect or any other content wouldn't run the
+// event.
+func displaysFlashes(header http.Header) bool {
+	if header.Get("HX-Redirect") != "" || header.Get("HX-Location") != "" {
+		return false
+	}
+
+	content_type := header.Get("Content-Type")
+	return content_type == "" || strings.HasPrefix(content_type, "text/html")
+}
+
+// Keeps the flashes for the next request, in the session when the user is
+// logged in. The session may be gone by now (e.g. after a logout or a
+// rotation), in which case the cookie is used.
+func (sm *SessionManager[User]) saveFlashes(w http.ResponseWriter, r *http.Request, flashes []Flash, had_cookie bool) {
+	if GetUserSession[User](r.Context()) != nil {
+		err := sm.updateSession(r, func(info *SessionInfo[User]) {
+			info.Flashes = flashes
+		})
+		if err == nil {
+			if had_cookie {
+				sm.clearFlashCookie(w)
+			}
+			return
+		} else if !errors.Is(err, ErrSessionNotFound) {
+			log.Printf("failed to save flashes: %v", err)
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     flashCookie,
+		Value:    sm.encodeFlashCookie(flashes),
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(flashCookieMaxAge.Seconds()),
+	})
+}
+
+func (sm *SessionManager[User]) clearSessionFlashes(r *http.Request) {
+	err := sm.updateSession(r, func(info *SessionInfo[User]) {
+		info.Flashes = nil
+	})
+	if err != nil && !errors.Is(err, ErrSessionNotFound) {
+		log.Printf("failed to clear flashes: %v", err)
+	}
+}
+
+func (sm *SessionManager[User]) clearFlashCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     flashCookie,
+		Value:    "",
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   -1,
+	})
+}
+
+// Signed so nobody can plant messages on someone else's browser, such as a
+// fake "call support at this number".
+func (sm *SessionManager[User]) encodeFlashCookie(flashes []Flash) string {
+	data, err := json.Marshal(flashes)
+	if err != nil {
+		panic("unreachable error on flash.go: " + err.Error())
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(sm.signFlashes(payload))
+}
+
+func (sm *SessionManager[User]) decodeFlashCookie(value string) ([]Flash, bool) {
+	payload, encoded_sig, ok := strings.Cut(value, ".")
+	if !ok {
+		return nil, false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encoded_sig)
+	if err != nil || !hmac.Equal(sig, sm.signFlashes(payload)) {
+		return nil, false
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, false
+	}
+	var flashes []Flash
+	err = json.Unmarshal(data, &flashes)
+	if err != nil {
+		return nil, false
+	}
+
+	return flashes, true
+}
+
+func (sm *SessionManager[User]) signFlashes(payload string) []byte {
+	mac := hmac.New(sha256.New, sm.signingKey)
+	mac.Write([]byte("flash:"))
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// Adds the flash event to `HX-Trigger`, keeping the events the handler already
+// set there, either as JSON or as a comma separated list of names.
+func setFlashTrigger(header http.Header, flashes []Flash) {
+	events := map[string]any{}
+	if existing := header.Get("HX-Trigger"); existing != "" {
+		if json.Unmarshal([]byte(existing), &events) != nil {
+			for _, name := range strings.Split(existing, ",") {
+				events[strings.TrimSpace(name)] = nil
+			}
+		}
+	}
+	events[FlashEvent] = flashes
+
+	data, err := json.Marshal(events)
+	if err != nil {
+		log.Printf("failed to encode flashes: %v", err)
+		return
+	}
+	header.Set("HX-Trigger", string(data))
+}
+
+// Holds the status until the first write, when the body is ready: templ
+// renders the whole page before writing it, so by then the page already read
+// its flashes, even if the handler called WriteHeader first. It's also the
+// last moment headers (and so cookies) can change.
+type flashWriter struct {
+	http.ResponseWriter
+	before    func(status int)
+	status    int
+	committed bool
+}
+
+func (fw *flashWriter) WriteHeader(status int) {
+	if status < 200 {
+		fw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if fw.status == 0 {
+		fw.status = status
+	}
+}
+
+func (fw *flashWriter) Write(b []byte) (int, error) {
+	fw.commit()
+	return fw.ResponseWriter.Write(b)
+}
+
+func (fw *flashWriter) Flush() {
+	fw.commit()
+	if f, ok := fw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (fw *flashWriter) commit() {
+	if fw.committed {
+		return
+	}
+	fw.committed = true
+
+	if fw.status == 0 {
+		fw.status = http.StatusOK
+	}
+	fw.before(fw.status)
+	fw.ResponseWriter.WriteHeader(fw.status)
+}
+
+// Lets http.ResponseController reach the original writer.
+func (fw *flashWriter) Unwrap() http.ResponseWriter {
+	return fw.ResponseWriter
+}
@@ -0,0 +1,183 @@
+package services
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// How long the user has to login on the provider.
+const oidcFlowTimeout = 10 * time.Minute
+
+// What the callback needs to finish a login started on this browser, kept on
+// the session store under the id sent in the `oidc` cookie.
+type oidcFlow struct {
+	Provider string
+	State    string
+	Nonce    string
+	Verifier string
+	Next     string
+}
+
+var (
+	errUnknownProvider = errors.New("unknown identity provider")
+	errStateMismatch   = errors.New("oidc state doesn't match")
+)
+
+func oidcFlowKey(id string) string {
+	return "oidc_flow:" + id
+}
+
+type resolveFunc[User any] func(r *http.Request, provider string, claims *IDTokenClaims) (*User, error)
+
+// Registers `GET /login/oidc/{provider}`, which sends the user to the
+// provider, and `GET /login/oidc/{provider}/callback`, where they come back.
+// The redirect URL of every provider must point to the latter. rf finds or
+// creates the user of the verified ID token, returning nil without an error
+// to refuse the login, which sends the user back to the login page.
+func (sm *SessionManager[User]) OIDCRoute(router chi.Router, providers *OIDCRegistry, rf resolveFunc[User]) {
+	router.Get("/login/oidc/{provider}", func(w http.ResponseWriter, r *http.Request) {
+		provider, ok := providers.Get(chi.URLParam(r, "provider"))
+		if !ok {
+			sm.renderError(w, r, http.StatusNotFound, errUnknownProvider)
+			return
+		}
+
+		id := randomToken()
+		flow := oidcFlow{
+			Provider: provider.Name(),
+			State:    randomToken(),
+			Nonce:    randomToken(),
+			Verifier: randomToken(),
+			Next:     r.URL.Query().Get("next"),
+		}
+		var buf bytes.Buffer
+		err := gob.NewEncoder(&buf).Encode(flow)
+		if err != nil {
+			log.Printf("failed to encode oidc flow: [%v]", err)
+			sm.renderError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		err = sm.store.Set(r.Context(), oidcFlowKey(id), buf.Bytes(), oidcFlowTimeout)
+		if err != nil {
+			log.Printf("%v", err)
+			sm.renderError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		// Lax, since the browser comes back from the provider on a cross-site
+		// navigation.
+		http.SetCookie(w, &http.Cookie{
+			Name:     "oidc",
+			Value:    id,
+			Path:     "/login/oidc",
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+			MaxAge:   int(oidcFlowTimeout.Seconds()),
+		})
+		http.Redirect(w, r, provider.AuthCodeURL(flow.State, flow.Nonce, flow.Verifier), http.StatusFound)
+	})
+
+	router.Get("/login/oidc/{provider}/callback", func(w http.ResponseWriter, r *http.Request) {
+		flow, err := sm.takeOIDCFlow(w, r)
+		if err != nil {
+			log.Printf("%v", err)
+			sm.renderError(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		// The state ties the callback to the browser that started the login,
+		// so nobody can log a victim into the attacker's account.
+		provider, ok := providers.Get(chi.URLParam(r, "provider"))
+		if !ok || provider.Name() != flow.Provider || r.URL.Query().Get("state") != flow.State {
+			sm.renderError(w, r, http.StatusBadRequest, errStateMismatch)
+			return
+		}
+		if r.URL.Query().Has("error") {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+
+		raw, err := provider.Exchange(r.Context(), r.URL.Query().Get("code"), flow.Verifier)
+		if err != nil {
+			log.Printf("%v", err)
+			sm.renderError(w, r, http.StatusBadGateway, err)
+			return
+		}
+		claims, err := provider.VerifyIDToken(r.Context(), raw, flow.Nonce, time.Now())
+		if err != nil {
+			log.Printf("%v", err)
+			sm.renderError(w, r, http.StatusForbidden, err)
+			return
+		}
+
+		user, err := rf(r, provider.Name(), claims)
+		if err != nil {
+			log.Printf("%v", err)
+			sm.renderError(w, r, http.StatusInternalServerError, err)
+			return
+		} else if user == nil {
+			AddFlash(w, r, FlashError, fmt.Sprintf("Couldn't log in with %s, if you already have an account log in with your password", provider.Name()))
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+
+		sm.dropSession(w, r)
+		location, err := sm.startSession(w, r, *user, flow.Next)
+		if err != nil {
+			log.Printf("%v", err)
+			sm.renderError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		// The session cookie is SameSite=Strict, so a redirect would still be
+		// part of the navigation that came from the provider and the browser
+		// wouldn't send it. Moving on from our own page avoids that.
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, `<!DOCTYPE html><meta http-equiv="refresh" content="0;url=%[1]s"><a href="%[1]s">Continue</a>`, html.EscapeString(location))
+	})
+}
+
+// Reads the flow of the `oidc` cookie and deletes it, so a callback URL only
+// works once.
+func (sm *SessionManager[User]) takeOIDCFlow(w http.ResponseWriter, r *http.Request) (oidcFlow, error) {
+	var flow oidcFlow
+
+	cookie, err := r.Cookie("oidc")
+	if err != nil {
+		return flow, fmt.Errorf("oidc callback without cookie")
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "oidc",
+		Value:    "",
+		Path:     "/login/oidc",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   -1,
+	})
+
+	data, err := sm.store.Get(r.Context(), oidcFlowKey(cookie.Value))
+	if errors.Is(err, ErrSessionNotFound) {
+		return flow, fmt.Errorf("oidc flow expired or already used")
+	} else if err != nil {
+		return flow, err
+	}
+	err = sm.store.Delete(r.Context(), oidcFlowKey(cookie.Value))
+	if err != nil && !errors.Is(err, ErrSessionNotFound) {
+		return flow, err
+	}
+
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(&flow)
+	if err != nil {
+		return flow, fmt.Errorf("failed to decode oidc flow: [%v]", err)
+	}
+
+	return flow, nil
+}
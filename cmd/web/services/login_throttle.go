@@ -0,0 +1,306 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Failed logins of a key since its counter was last reset.
+type LoginFailures struct {
+	Count int
+	Last  time.Time
+}
+
+// Backend where the LoginThrottle counts failures. It must be shared by every
+// instance of the app, otherwise each one gives attackers their own budget.
+type ThrottleStore interface {
+	// Returns the zero value when the key has no failures.
+	Failures(ctx context.Context, key string) (LoginFailures, error)
+	// Counts a failure atomically, keeping the counter for ttl after it.
+	AddFailure(ctx context.Context, key string, at time.Time, ttl time.Duration) (LoginFailures, error)
+	// Takes back a failure counted by AddFailure with the same ttl, never going
+	// below zero.
+	RemoveFailure(ctx context.Context, key string, ttl time.Duration) error
+	Reset(ctx context.Context, key string) error
+}
+
+// How failures of a key are punished. The first FreeAttempts failures cost
+// nothing, after those each one makes the next attempt wait BaseDelay, doubling
+// up to MaxDelay. Reaching LockoutAfter failures locks the key for
+// LockoutDuration. Failures are forgotten after Window without new ones.
+type ThrottlePolicy struct {
+	FreeAttempts    int
+	BaseDelay       time.Duration
+	MaxDelay        time.Duration
+	LockoutAfter    int
+	LockoutDuration time.Duration
+	Window          time.Duration
+}
+
+// How long the key must wait after its failures, zero if it can try now.
+func (p ThrottlePolicy) wait(f LoginFailures, now time.Time) time.Duration {
+	var until time.Time
+	switch {
+	case f.Count >= p.LockoutAfter:
+		until = f.Last.Add(p.LockoutDuration)
+	case f.Count > p.FreeAttempts:
+		delay := p.BaseDelay
+		for i := p.FreeAttempts + 1; i < f.Count && delay < p.MaxDelay; i++ {
+			delay *= 2
+		}
+		until = f.Last.Add(min(delay, p.MaxDelay))
+	default:
+		return 0
+	}
+
+	return max(until.Sub(now), 0)
+}
+
+func (p ThrottlePolicy) ttl() time.Duration {
+	return max(p.Window, p.LockoutDuration)
+}
+
+var (
+	DefaultIPPolicy = ThrottlePolicy{
+		FreeAttempts:    10,
+		BaseDelay:       time.Second,
+		MaxDelay:        time.Minute,
+		LockoutAfter:    100,
+		LockoutDuration: time.Hour,
+		Window:          time.Hour,
+	}
+	DefaultAccountPolicy = ThrottlePolicy{
+		FreeAttempts:    3,
+		BaseDelay:       time.Second,
+		MaxDelay:        30 * time.Second,
+		LockoutAfter:    10,
+		LockoutDuration: 15 * time.Minute,
+		Window:          time.Hour,
+	}
+)
+
+// Returned by LoginThrottle.Attempt while the client must wait. The login route
+// answers it with 429 and a `Retry-After` header.
+type ThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("too many failed logins, retry after %v", e.RetryAfter)
+}
+
+type LoginThrottleOption func(*LoginThrottle)
+
+// Policy for failures coming from the same IP, whatever the account. It should
+// be looser than the account one, since many users can share an address.
+func WithIPPolicy(p ThrottlePolicy) LoginThrottleOption {
+	return func(lt *LoginThrottle) {
+		lt.by_ip = p
+	}
+}
+
+// Policy for failures on the same account, whatever the IP.
+func WithAccountPolicy(p ThrottlePolicy) LoginThrottleOption {
+	return func(lt *LoginThrottle) {
+		lt.by_account = p
+	}
+}
+
+// Slows down guessing of passwords and second factor codes by counting failed
+// logins per IP and per account. Every attempt is counted as failed before the
+// password is compared, and only given back once it turns out right, so
+// throttled clients don't cost a hash either.
+type LoginThrottle struct {
+	store      ThrottleStore
+	by_ip      ThrottlePolicy
+	by_account ThrottlePolicy
+}
+
+func NewLoginThrottle(store ThrottleStore, opts ...LoginThrottleOption) *LoginThrottle {
+	lt := &LoginThrottle{
+		store:      store,
+		by_ip:      DefaultIPPolicy,
+		by_account: DefaultAccountPolicy,
+	}
+	for _, opt := range opts {
+		opt(lt)
+	}
+
+	return lt
+}
+
+// Reserves a failure on the IP and the account before the credentials are
+// checked, returning a ThrottledError if either must wait before trying again.
+// Attempts made at the same time all read the same failures, so each one is
+// decided on the count its own reservation got: only the first can rely on the
+// last failure being old, the others come right after a failure and must wait
+// like it. The reservation stays unless Release or Succeeded give it back.
+func (lt *LoginThrottle) Attempt(ctx context.Context, ip string, email string) error {
+	now := time.Now()
+	keys := lt.keys(ip, email)
+
+	// Clients that must wait already are refused without counting the attempt,
+	// so retrying early doesn't make the wait longer.
+	before := make([]LoginFailures, len(keys))
+	wait := time.Duration(0)
+	for i, k := range keys {
+		f, err := lt.store.Failures(ctx, k.key)
+		if err != nil {
+			return err
+		}
+		before[i] = f
+		wait = max(wait, k.policy.wait(f, now))
+	}
+	if wait > 0 {
+		return &ThrottledError{RetryAfter: wait}
+	}
+
+	for i, k := range keys {
+		f, err := lt.store.AddFailure(ctx, k.key, now, k.policy.ttl())
+		if err != nil {
+			return err
+		}
+
+		previous := LoginFailures{Count: f.Count - 1, Last: now}
+		if previous.Count == before[i].Count {
+			previous.Last = before[i].Last
+		}
+		wait = max(wait, k.policy.wait(previous, now))
+	}
+
+	if wait > 0 {
+		return &ThrottledError{RetryAfter: wait}
+	}
+	return nil
+}
+
+// Gives back the failures reserved by Attempt, for credentials that are right
+// but don't finish the login yet.
+func (lt *LoginThrottle) Release(ctx context.Context, ip string, email string) error {
+	for _, k := range lt.keys(ip, email) {
+		err := lt.store.RemoveFailure(ctx, k.key, k.policy.ttl())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Gives back the failure reserved on the IP and forgets the ones of the
+// account. The older failures of the IP are kept, otherwise an attacker could
+// clear them by logging into their own account.
+func (lt *LoginThrottle) Succeeded(ctx context.Context, ip string, email string) error {
+	err := lt.store.RemoveFailure(ctx, lt.ipKey(ip), lt.by_ip.ttl())
+	if err != nil {
+		return err
+	}
+
+	return lt.store.Reset(ctx, lt.accountKey(email))
+}
+
+type throttleKey struct {
+	key    string
+	policy ThrottlePolicy
+}
+
+func (lt *LoginThrottle) keys(ip string, email string) []throttleKey {
+	return []throttleKey{
+		{key: lt.ipKey(ip), policy: lt.by_ip},
+		{key: lt.accountKey(email), policy: lt.by_account},
+	}
+}
+
+func (lt *LoginThrottle) ipKey(ip string) string {
+	return throttleHash("ip:" + ip)
+}
+
+func (lt *LoginThrottle) accountKey(email string) string {
+	return throttleHash("account:" + strings.ToLower(strings.TrimSpace(email)))
+}
+
+// Emails are user input, hashing them keeps the keys valid on every store and
+// out of the logs.
+func throttleHash(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return "login:" + hex.EncodeToString(hash[:])
+}
+
+// Throttle store in the process memory, only for deployments with a single
+// instance.
+type MemoryThrottleStore struct {
+	mu        sync.Mutex
+	failures  map[string]memoryFailures
+	lastPurge time.Time
+}
+
+type memoryFailures struct {
+	LoginFailures
+	expiresAt time.Time
+}
+
+func NewMemoryThrottleStore() *MemoryThrottleStore {
+	return &MemoryThrottleStore{failures: make(map[string]memoryFailures)}
+}
+
+func (ms *MemoryThrottleStore) Failures(ctx context.Context, key string) (LoginFailures, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	f, ok := ms.failures[key]
+	if !ok || time.Now().After(f.expiresAt) {
+		return LoginFailures{}, nil
+	}
+
+	return f.LoginFailures, nil
+}
+
+func (ms *MemoryThrottleStore) AddFailure(ctx context.Context, key string, at time.Time, ttl time.Duration) (LoginFailures, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if at.Sub(ms.lastPurge) >= time.Minute {
+		for k, f := range ms.failures {
+			if at.After(f.expiresAt) {
+				delete(ms.failures, k)
+			}
+		}
+		ms.lastPurge = at
+	}
+
+	f, ok := ms.failures[key]
+	if !ok || at.After(f.expiresAt) {
+		f = memoryFailures{}
+	}
+	f.Count++
+	f.Last = at
+	f.expiresAt = at.Add(ttl)
+	ms.failures[key] = f
+
+	return f.LoginFailures, nil
+}
+
+func (ms *MemoryThrottleStore) RemoveFailure(ctx context.Context, key string, ttl time.Duration) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	f, ok := ms.failures[key]
+	if ok && f.Count > 0 {
+		f.Count--
+		ms.failures[key] = f
+	}
+	return nil
+}
+
+func (ms *MemoryThrottleStore) Reset(ctx context.Context, key string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	delete(ms.failures, key)
+	return nil
+}
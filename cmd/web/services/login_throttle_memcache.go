@@ -0,0 +1,153 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// Throttle store backed by memcached. Counters are updated with
+// compare-and-swap, so concurrent failures on different instances aren't lost.
+type MemcacheThrottleStore struct {
+	mc *memcache.Client
+}
+
+func NewMemcacheThrottleStore(servers ...string) (*MemcacheThrottleStore, error) {
+	mc := memcache.New(servers...)
+	err := mc.Ping()
+	if err != nil {
+		return nil, fmt.Errorf("failed to ping memcache: [%v]", err)
+	}
+
+	return &MemcacheThrottleStore{mc: mc}, nil
+}
+
+func (ms *MemcacheThrottleStore) Failures(ctx context.Context, key string) (LoginFailures, error) {
+	item, err := ms.mc.Get(key)
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return LoginFailures{}, nil
+	} else if err != nil {
+		return LoginFailures{}, fmt.Errorf("failed to get from memcache: [%v]", err)
+	}
+
+	return decodeFailures(item.Value)
+}
+
+func (ms *MemcacheThrottleStore) AddFailure(ctx context.Context, key string, at time.Time, ttl time.Duration) (LoginFailures, error) {
+	// Only retried when another instance changed the key in between.
+	for range 10 {
+		item, err := ms.mc.Get(key)
+		if errors.Is(err, memcache.ErrCacheMiss) {
+			f := LoginFailures{Count: 1, Last: at}
+			err = ms.mc.Add(&memcache.Item{
+				Key:        key,
+				Value:      encodeFailures(f),
+				Expiration: memcacheExpiration(ttl),
+			})
+			if errors.Is(err, memcache.ErrNotStored) {
+				continue
+			} else if err != nil {
+				return LoginFailures{}, fmt.Errorf("failed to save to memcache: [%v]", err)
+			}
+
+			return f, nil
+		} else if err != nil {
+			return LoginFailures{}, fmt.Errorf("failed to get from memcache: [%v]", err)
+		}
+
+		f, err := decodeFailures(item.Value)
+		if err != nil {
+			return LoginFailures{}, err
+		}
+		f.Count++
+		f.Last = at
+		item.Value = encodeFailures(f)
+		item.Expiration = memcacheExpiration(ttl)
+
+		err = ms.mc.CompareAndSwap(item)
+		if errors.Is(err, memcache.ErrCASConflict) || errors.Is(err, memcache.ErrNotStored) {
+			continue
+		} else if err != nil {
+			return LoginFailures{}, fmt.Errorf("failed to save to memcache: [%v]", err)
+		}
+
+		return f, nil
+	}
+
+	return LoginFailures{}, fmt.Errorf("failed to count login failure: too much contention on memcache")
+}
+
+func (ms *MemcacheThrottleStore) RemoveFailure(ctx context.Context, key string, ttl time.Duration) error {
+	for range 10 {
+		item, err := ms.mc.Get(key)
+		if errors.Is(err, memcache.ErrCacheMiss) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to get from memcache: [%v]", err)
+		}
+
+		f, err := decodeFailures(item.Value)
+		if err != nil {
+			return err
+		}
+		// The expiration isn't returned by Get, it's set again from the last
+		// failure so the counter doesn't outlive it.
+		remaining := time.Until(f.Last.Add(ttl))
+		if f.Count == 0 || remaining <= 0 {
+			return nil
+		}
+		f.Count--
+		item.Value = encodeFailures(f)
+		item.Expiration = memcacheExpiration(max(remaining, time.Second))
+
+		err = ms.mc.CompareAndSwap(item)
+		if errors.Is(err, memcache.ErrCASConflict) {
+			continue
+		} else if errors.Is(err, memcache.ErrNotStored) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to save to memcache: [%v]", err)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("failed to remove login failure: too much contention on memcache")
+}
+
+func (ms *MemcacheThrottleStore) Reset(ctx context.Context, key string) error {
+	err := ms.mc.Delete(key)
+	if err != nil && !errors.Is(err, memcache.ErrCacheMiss) {
+		return fmt.Errorf("failed to delete from memcache: [%v]", err)
+	}
+
+	return nil
+}
+
+// Stored as `<count>:<unix nanoseconds of the last failure>`.
+func encodeFailures(f LoginFailures) []byte {
+	return []byte(fmt.Sprintf("%d:%d", f.Count, f.Last.UnixNano()))
+}
+
+func decodeFailures(value []byte) (LoginFailures, error) {
+	count, last, ok := strings.Cut(string(value), ":")
+	if !ok {
+		return LoginFailures{}, fmt.Errorf("invalid login failures value")
+	}
+
+	n, err := strconv.Atoi(count)
+	if err != nil {
+		return LoginFailures{}, fmt.Errorf("invalid login failures value: [%v]", err)
+	}
+	nanos, err := strconv.ParseInt(last, 10, 64)
+	if err != nil {
+		return LoginFailures{}, fmt.Errorf("invalid login failures value: [%v]", err)
+	}
+
+	return LoginFailures{Count: n, Last: time.Unix(0, nanos)}, nil
+}
@@ -0,0 +1,118 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/robertoesteves13/go-template/internal/database"
+)
+
+// Throttle store that counts failures in the `LoginThrottles` table. Expired
+// rows are ignored on read and removed by DeleteExpired.
+type PostgresThrottleStore struct {
+	acquire func(context.Context) (*pgxpool.Conn, error)
+}
+
+func NewPostgresThrottleStore(acquire func(context.Context) (*pgxpool.Conn, error)) *PostgresThrottleStore {
+	return &PostgresThrottleStore{acquire: acquire}
+}
+
+func (ps *PostgresThrottleStore) Failures(ctx context.Context, key string) (LoginFailures, error) {
+	conn, err := ps.acquire(ctx)
+	if err != nil {
+		return LoginFailures{}, fmt.Errorf("failed to get connection: [%v]", err)
+	}
+	defer conn.Release()
+
+	db := database.New(conn)
+	row, err := db.GetLoginThrottle(ctx, database.GetLoginThrottleParams{
+		ID:  key,
+		Now: timestamptz(time.Now()),
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		return LoginFailures{}, nil
+	} else if err != nil {
+		return LoginFailures{}, fmt.Errorf("failed to get login failures: [%v]", err)
+	}
+
+	return LoginFailures{Count: int(row.Failures), Last: row.LastFailure.Time}, nil
+}
+
+func (ps *PostgresThrottleStore) AddFailure(ctx context.Context, key string, at time.Time, ttl time.Duration) (LoginFailures, error) {
+	conn, err := ps.acquire(ctx)
+	if err != nil {
+		return LoginFailures{}, fmt.Errorf("failed to get connection: [%v]", err)
+	}
+	defer conn.Release()
+
+	db := database.New(conn)
+	row, err := db.AddLoginFailure(ctx, database.AddLoginFailureParams{
+		ID:        key,
+		At:        timestamptz(at),
+		ExpiresAt: timestamptz(at.Add(ttl)),
+	})
+	if err != nil {
+		return LoginFailures{}, fmt.Errorf("failed to save login failure: [%v]", err)
+	}
+
+	return LoginFailures{Count: int(row.Failures), Last: row.LastFailure.Time}, nil
+}
+
+func (ps *PostgresThrottleStore) RemoveFailure(ctx context.Context, key string, ttl time.Duration) error {
+	conn, err := ps.acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get connection: [%v]", err)
+	}
+	defer conn.Release()
+
+	db := database.New(conn)
+	err = db.RemoveLoginFailure(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to remove login failure: [%v]", err)
+	}
+
+	return nil
+}
+
+func (ps *PostgresThrottleStore) Reset(ctx context.Context, key string) error {
+	conn, err := ps.acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get connection: [%v]", err)
+	}
+	defer conn.Release()
+
+	db := database.New(conn)
+	err = db.DeleteLoginThrottle(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to reset login failures: [%v]", err)
+	}
+
+	return nil
+}
+
+// Removes the expired counters, run it periodically if the table grows too
+// much.
+func (ps *PostgresThrottleStore) DeleteExpired(ctx context.Context) error {
+	conn, err := ps.acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get connection: [%v]", err)
+	}
+	defer conn.Release()
+
+	db := database.New(conn)
+	err = db.DeleteExpiredLoginThrottles(ctx, timestamptz(time.Now()))
+	if err != nil {
+		return fmt.Errorf("failed to delete expired login failures: [%v]", err)
+	}
+
+	return nil
+}
+
+func timestamptz(t time.Time) pgtype.Timestamptz {
+	return pgtype.Timestamptz{Time: t, Valid: true}
+}
@@ -0,0 +1,87 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sends emails. See SMTPMailer, LogMailer, FileMailer and MemoryMailer for the
+// available implementations.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// Prints the emails to stdout instead of sending them, handy for development
+// since the links can be copied from the logs.
+type LogMailer struct{}
+
+func (LogMailer) Send(ctx context.Context, msg Message) error {
+	log.Printf("email to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
+
+// Keeps the emails in memory, so tests can check what would have been sent.
+type MemoryMailer struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func NewMemoryMailer() *MemoryMailer {
+	return &MemoryMailer{}
+}
+
+func (mm *MemoryMailer) Send(ctx context.Context, msg Message) error {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+
+	mm.messages = append(mm.messages, msg)
+	return nil
+}
+
+// Every email sent so far, oldest first.
+func (mm *MemoryMailer) Messages() []Message {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+
+	return append([]Message(nil), mm.messages...)
+}
+
+// Appends the emails to a file, for development setups where stdout is too
+// noisy to find them.
+type FileMailer struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewFileMailer(path string) *FileMailer {
+	return &FileMailer{path: path}
+}
+
+func (fm *FileMailer) Send(ctx context.Context, msg Message) error {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+
+	f, err := os.OpenFile(fm.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open mail file: %v", err)
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintf(f, "To: %s\nSubject: %s\nDate: %s\n\n%s\n\n", msg.To, msg.Subject, time.Now().Format(time.RFC1123Z), msg.Body)
+	if err != nil {
+		return fmt.Errorf("failed to write mail file: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,64 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Sends the emails through an SMTP server. The connection is upgraded with
+// STARTTLS when the server supports it, and the credentials are only sent
+// over TLS (or to localhost), as net/smtp enforces.
+type SMTPMailer struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+// Leave username empty for servers that don't need authentication.
+func NewSMTPMailer(host string, port string, username string, password string, from string) *SMTPMailer {
+	var auth smtp.Auth
+	if username != "" {
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+
+	return &SMTPMailer{addr: net.JoinHostPort(host, port), auth: auth, from: from}
+}
+
+func (sm *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	// Header values can't span lines, otherwise an address could inject
+	// headers of its own.
+	if strings.ContainsAny(msg.To+msg.Subject, "\r\n") {
+		return fmt.Errorf("invalid email header")
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "From: %s\r\n", sm.from)
+	fmt.Fprintf(&body, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&body, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&body, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	body.WriteString("MIME-Version: 1.0\r\n")
+	body.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	body.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+
+	// net/smtp has no context support, so the send runs in the background and
+	// is abandoned if the context ends first.
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(sm.addr, sm.auth, sm.from, []string{msg.To}, []byte(body.String()))
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("failed to send email: %v", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("failed to send email: %v", ctx.Err())
+	}
+}
@@ -0,0 +1,178 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	highlighting "github.com/yuin/goldmark-highlighting/v2"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+)
+
+// Entry of the table of contents, one for each heading of the document.
+type Heading struct {
+	Level int
+	ID    string
+	Text  string
+}
+
+// Sanitized HTML of a markdown document, ready to be written on the page.
+type Markdown struct {
+	HTML            string
+	TableOfContents []Heading
+}
+
+type markdownEntry struct {
+	version  time.Time
+	markdown Markdown
+}
+
+// Renders markdown to sanitized HTML, caching the result of each document by
+// its version so unchanged documents are rendered only once.
+type MarkdownRenderer struct {
+	md         goldmark.Markdown
+	policy     *bluemonday.Policy
+	style      string
+	maxEntries int
+
+	mu    sync.Mutex
+	cache map[string]markdownEntry
+}
+
+type MarkdownOption func(*markdownConfig)
+
+type markdownConfig struct {
+	style      string
+	maxEntries int
+}
+
+// Highlights code blocks on the server with the given chroma style, such as
+// "github" or "monokai". The colors come from the stylesheet served by
+// StylesheetHandler.
+func WithSyntaxHighlighting(style string) MarkdownOption {
+	return func(c *markdownConfig) {
+		c.style = style
+	}
+}
+
+// Maximum amount of documents kept in the cache. Defaults to 1000.
+func WithCacheSize(entries int) MarkdownOption {
+	return func(c *markdownConfig) {
+		c.maxEntries = entries
+	}
+}
+
+func NewMarkdownRenderer(opts ...MarkdownOption) *MarkdownRenderer {
+	cfg := markdownConfig{maxEntries: 1000}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	extensions := []goldmark.Extender{extension.GFM}
+	if cfg.style != "" {
+		extensions = append(extensions, highlighting.NewHighlighting(
+			highlighting.WithStyle(cfg.style),
+			highlighting.WithFormatOptions(chromahtml.WithClasses(true)),
+		))
+	}
+
+	// Raw HTML is already escaped by goldmark, the policy is a second layer
+	// in case an extension lets something slip through.
+	policy := bluemonday.UGCPolicy()
+	policy.AllowAttrs("class").Matching(regexp.MustCompile(`^[a-zA-Z0-9 _-]+$`)).OnElements("span", "pre", "code")
+
+	return &MarkdownRenderer{
+		md: goldmark.New(
+			goldmark.WithExtensions(extensions...),
+			goldmark.WithParserOptions(parser.WithAutoHeadingID()),
+		),
+		policy:     policy,
+		style:      cfg.style,
+		maxEntries: cfg.maxEntries,
+		cache:      make(map[string]markdownEntry),
+	}
+}
+
+// Renders the document identified by key. If the same key was rendered with
+// the same version before, the cached result is returned instead.
+func (mr *MarkdownRenderer) Render(key string, version time.Time, source string) (Markdown, error) {
+	mr.mu.Lock()
+	entry, ok := mr.cache[key]
+	mr.mu.Unlock()
+	if ok && entry.version.Equal(version) {
+		return entry.markdown, nil
+	}
+
+	src := []byte(source)
+	doc := mr.md.Parser().Parse(text.NewReader(src))
+
+	var buf bytes.Buffer
+	err := mr.md.Renderer().Render(&buf, src, doc)
+	if err != nil {
+		return Markdown{}, fmt.Errorf("failed to render markdown: [%v]", err)
+	}
+
+	markdown := Markdown{
+		HTML:            mr.policy.Sanitize(buf.String()),
+		TableOfContents: tableOfContents(doc, src),
+	}
+
+	mr.mu.Lock()
+	if len(mr.cache) >= mr.maxEntries {
+		// Evicts an arbitrary entry, good enough to keep the memory bounded.
+		for k := range mr.cache {
+			delete(mr.cache, k)
+			break
+		}
+	}
+	mr.cache[key] = markdownEntry{version: version, markdown: markdown}
+	mr.mu.Unlock()
+
+	return markdown, nil
+}
+
+func tableOfContents(doc ast.Node, src []byte) []Heading {
+	headings := make([]Heading, 0)
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if heading, ok := n.(*ast.Heading); ok && entering {
+			id, _ := heading.AttributeString("id")
+			id_bytes, _ := id.([]byte)
+			headings = append(headings, Heading{
+				Level: heading.Level,
+				ID:    string(id_bytes),
+				Text:  string(heading.Text(src)),
+			})
+
+			return ast.WalkSkipChildren, nil
+		}
+
+		return ast.WalkContinue, nil
+	})
+
+	return headings
+}
+
+// Serves the CSS with the colors used by the syntax highlighting. It's empty
+// when highlighting is disabled.
+func (mr *MarkdownRenderer) StylesheetHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/css; charset=utf-8")
+	if mr.style == "" {
+		return
+	}
+
+	formatter := chromahtml.New(chromahtml.WithClasses(true))
+	err := formatter.WriteCSS(w, styles.Get(mr.style))
+	if err != nil {
+		http.Error(w, "500 internal server error", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,25 @@
+package services
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Name of the form field that overrides the method of a POST request.
+const MethodOverrideField = "_method"
+
+// Middleware that lets HTML forms, which can only send GET and POST, reach
+// PUT, PATCH and DELETE routes through an hidden `_method` field. It must run
+// before the router matches the route, so register it with `Use`.
+func MethodOverride(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			switch method := strings.ToUpper(r.PostFormValue(MethodOverrideField)); method {
+			case http.MethodPut, http.MethodPatch, http.MethodDelete:
+				r.Method = method
+			}
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
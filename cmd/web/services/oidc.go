@@ -0,0 +1,209 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+type OIDCConfig struct {
+	// Must be exactly the `iss` of the ID tokens, the discovery document is
+	// read from `<Issuer>/.well-known/openid-configuration`.
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	// Defaults to openid, email and profile.
+	Scopes []string
+	// Defaults to a client with a 10 seconds timeout.
+	HTTPClient *http.Client
+}
+
+// Client of an OpenID Connect provider using the authorization code flow with
+// PKCE. Only what's needed to login is supported: discovery, the token
+// exchange and the verification of ID tokens signed with RS256 or ES256.
+type OIDCProvider struct {
+	name   string
+	cfg    OIDCConfig
+	client *http.Client
+
+	authorization_endpoint string
+	token_endpoint         string
+	keys                   *jwkSet
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Reads the discovery document of the issuer, so it fails when the provider
+// can't be reached.
+func NewOIDCProvider(ctx context.Context, name string, cfg OIDCConfig) (*OIDCProvider, error) {
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	} else if !slices.Contains(cfg.Scopes, "openid") {
+		cfg.Scopes = append([]string{"openid"}, cfg.Scopes...)
+	}
+	client := cfg.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	p := &OIDCProvider{name: name, cfg: cfg, client: client}
+
+	var doc oidcDiscovery
+	err := p.getJSON(ctx, strings.TrimSuffix(cfg.Issuer, "/")+"/.well-known/openid-configuration", &doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover %s: [%v]", name, err)
+	}
+	if doc.Issuer != cfg.Issuer {
+		return nil, fmt.Errorf("failed to discover %s: issuer is `%s`, expected `%s`", name, doc.Issuer, cfg.Issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return nil, fmt.Errorf("failed to discover %s: missing endpoints", name)
+	}
+
+	p.authorization_endpoint = doc.AuthorizationEndpoint
+	p.token_endpoint = doc.TokenEndpoint
+	p.keys = newJWKSet(doc.JWKSURI, p.getJSON)
+	return p, nil
+}
+
+func (p *OIDCProvider) Name() string {
+	return p.name
+}
+
+// Where the user is sent to login. The verifier is the PKCE secret, only its
+// hash goes in the URL.
+func (p *OIDCProvider) AuthCodeURL(state string, nonce string, verifier string) string {
+	challenge := sha256.Sum256([]byte(verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.cfg.ClientID},
+		"redirect_uri":          {p.cfg.RedirectURL},
+		"scope":                 {strings.Join(p.cfg.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	separator := "?"
+	if strings.Contains(p.authorization_endpoint, "?") {
+		separator = "&"
+	}
+	return p.authorization_endpoint + separator + params.Encode()
+}
+
+// Trades the code sent to the redirect URL for the ID token, which still has
+// to be checked with VerifyIDToken.
+func (p *OIDCProvider) Exchange(ctx context.Context, code string, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.token_endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("failed to create token request: [%v]", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to exchange code: [%v]", err)
+	}
+	defer res.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	err = json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&body)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode token response: [%v]", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to exchange code: %s %s", body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return "", fmt.Errorf("token response has no id_token")
+	}
+
+	return body.IDToken, nil
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %s", url, res.Status)
+	}
+
+	return json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(v)
+}
+
+// The providers the users can login with, by name.
+type OIDCRegistry struct {
+	providers map[string]*OIDCProvider
+}
+
+func NewOIDCRegistry() *OIDCRegistry {
+	return &OIDCRegistry{providers: make(map[string]*OIDCProvider)}
+}
+
+func (reg *OIDCRegistry) Register(p *OIDCProvider) {
+	reg.providers[p.name] = p
+}
+
+func (reg *OIDCRegistry) Get(name string) (*OIDCProvider, bool) {
+	p, ok := reg.providers[name]
+	return p, ok
+}
+
+// Names of the providers in alphabetical order, for the login page.
+func (reg *OIDCRegistry) Names() []string {
+	names := make([]string, 0, len(reg.providers))
+	for name := range reg.providers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	return names
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic("unreachable error on oidc.go: " + err.Error())
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,261 @@
+package services
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrInvalidIDToken = errors.New("invalid id token")
+
+// Clocks of the provider and the app are never exactly the same.
+const idTokenLeeway = time.Minute
+
+// Claims of a verified ID token.
+type IDTokenClaims struct {
+	Issuer          string      `json:"iss"`
+	Subject         string      `json:"sub"`
+	Audience        audience    `json:"aud"`
+	AuthorizedParty string      `json:"azp"`
+	Expiry          json.Number `json:"exp"`
+	IssuedAt        json.Number `json:"iat"`
+	Nonce           string      `json:"nonce"`
+	Email           string      `json:"email"`
+	EmailVerified   looseBool   `json:"email_verified"`
+	Name            string      `json:"name"`
+}
+
+// The `aud` claim is either a string or a list of them.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if json.Unmarshal(data, &single) == nil {
+		*a = audience{single}
+		return nil
+	}
+
+	var list []string
+	err := json.Unmarshal(data, &list)
+	*a = list
+	return err
+}
+
+// Some providers send `email_verified` as the string "true".
+type looseBool bool
+
+func (b *looseBool) UnmarshalJSON(data []byte) error {
+	*b = looseBool(string(data) == "true" || string(data) == `"true"`)
+	return nil
+}
+
+// Checks the signature and the claims of the ID token: it must come from the
+// issuer, be meant for this client, not be expired and carry the nonce sent
+// with the authorization request.
+func (p *OIDCProvider) VerifyIDToken(ctx context.Context, raw string, nonce string, now time.Time) (*IDTokenClaims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed", ErrInvalidIDToken)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err := decodeSegment(parts[0], &header)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad header: [%v]", ErrInvalidIDToken, err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad signature encoding", ErrInvalidIDToken)
+	}
+
+	key, err := p.keys.get(ctx, header.Kid, header.Alg)
+	if err != nil {
+		return nil, err
+	}
+	err = verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims IDTokenClaims
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad claims: [%v]", ErrInvalidIDToken, err)
+	}
+
+	switch {
+	case claims.Issuer != p.cfg.Issuer:
+		return nil, fmt.Errorf("%w: issuer is `%s`", ErrInvalidIDToken, claims.Issuer)
+	case claims.Subject == "":
+		return nil, fmt.Errorf("%w: missing subject", ErrInvalidIDToken)
+	case !slices.Contains(claims.Audience, p.cfg.ClientID):
+		return nil, fmt.Errorf("%w: not meant for this client", ErrInvalidIDToken)
+	case len(claims.Audience) > 1 && claims.AuthorizedParty != p.cfg.ClientID:
+		return nil, fmt.Errorf("%w: authorized party is `%s`", ErrInvalidIDToken, claims.AuthorizedParty)
+	case subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1:
+		return nil, fmt.Errorf("%w: nonce doesn't match", ErrInvalidIDToken)
+	}
+
+	exp, err := claims.Expiry.Float64()
+	if err != nil || now.Add(-idTokenLeeway).After(time.Unix(int64(exp), 0)) {
+		return nil, fmt.Errorf("%w: expired", ErrInvalidIDToken)
+	}
+	if iat, err := claims.IssuedAt.Float64(); err == nil && time.Unix(int64(iat), 0).After(now.Add(idTokenLeeway)) {
+		return nil, fmt.Errorf("%w: issued in the future", ErrInvalidIDToken)
+	}
+
+	return &claims, nil
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed []byte, sig []byte) error {
+	hash := sha256.Sum256(signed)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if alg == "RS256" && rsa.VerifyPKCS1v15(k, crypto.SHA256, hash[:], sig) == nil {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		if alg == "ES256" && len(sig) == 64 {
+			r := new(big.Int).SetBytes(sig[:32])
+			s := new(big.Int).SetBytes(sig[32:])
+			if ecdsa.Verify(k, hash[:], r, s) {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("%w: bad signature", ErrInvalidIDToken)
+}
+
+// Signing keys of the provider. They're fetched again when a token uses an
+// unknown key id, which is how providers rotate them, but at most once a
+// minute so forged tokens can't make us hammer the provider.
+type jwkSet struct {
+	url   string
+	fetch func(ctx context.Context, url string, v any) error
+
+	mu         sync.Mutex
+	keys       map[string]crypto.PublicKey
+	last_fetch time.Time
+}
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func newJWKSet(url string, fetch func(ctx context.Context, url string, v any) error) *jwkSet {
+	return &jwkSet{url: url, fetch: fetch}
+}
+
+func (s *jwkSet) get(ctx context.Context, kid string, alg string) (crypto.PublicKey, error) {
+	if alg != "RS256" && alg != "ES256" {
+		return nil, fmt.Errorf("%w: unsupported algorithm `%s`", ErrInvalidIDToken, alg)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if key, ok := s.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(s.last_fetch) < time.Minute {
+		return nil, fmt.Errorf("%w: unknown key `%s`", ErrInvalidIDToken, kid)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	err := s.fetch(ctx, s.url, &set)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch signing keys: [%v]", err)
+	}
+	s.last_fetch = time.Now()
+
+	s.keys = make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		s.keys[k.Kid] = key
+	}
+
+	if key, ok := s.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: unknown key `%s`", ErrInvalidIDToken, kid)
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) > 4 {
+			return nil, fmt.Errorf("invalid exponent")
+		}
+
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve `%s`", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("point is not on the curve")
+		}
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type `%s`", k.Kty)
+}
@@ -0,0 +1,407 @@
+package services
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const testClientID = "client"
+
+// Identity provider serving discovery, the signing keys and the token
+// endpoint, which answers with whatever token returns.
+type fakeIssuer struct {
+	server *httptest.Server
+
+	mu           sync.Mutex
+	keys         map[string]crypto.Signer
+	jwks_fetches int
+	challenge    string
+	token        func() string
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	t.Helper()
+
+	f := &fakeIssuer{keys: map[string]crypto.Signer{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                f.server.URL,
+			AuthorizationEndpoint: f.server.URL + "/authorize",
+			TokenEndpoint:         f.server.URL + "/token",
+			JWKSURI:               f.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.jwks_fetches++
+
+		keys := []jwk{}
+		for kid, key := range f.keys {
+			keys = append(keys, publicJWK(kid, key.Public()))
+		}
+		json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		expected, token := f.challenge, f.token
+		f.mu.Unlock()
+
+		id, secret, _ := r.BasicAuth()
+		challenge := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if id != testClientID || secret != "secret" || r.FormValue("code") != "code" ||
+			base64.RawURLEncoding.EncodeToString(challenge[:]) != expected {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": token()})
+	})
+	f.server = httptest.NewServer(mux)
+	t.Cleanup(f.server.Close)
+
+	return f
+}
+
+func (f *fakeIssuer) addKey(t *testing.T, kid string, alg string) {
+	t.Helper()
+
+	var key crypto.Signer
+	var err error
+	if alg == "ES256" {
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	} else {
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.keys[kid] = key
+}
+
+func (f *fakeIssuer) provider(t *testing.T) *OIDCProvider {
+	t.Helper()
+
+	p, err := NewOIDCProvider(context.Background(), "fake", OIDCConfig{
+		Issuer:       f.server.URL,
+		ClientID:     testClientID,
+		ClientSecret: "secret",
+		RedirectURL:  "http://app.test/login/oidc/fake/callback",
+		HTTPClient:   f.server.Client(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+// Sets the ID token answered by the token endpoint.
+func (f *fakeIssuer) respondWith(token func() string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.token = token
+}
+
+// Claims of a valid token for the provider, which tests tamper with.
+func (f *fakeIssuer) claims(nonce string) map[string]any {
+	now := time.Now()
+	return map[string]any{
+		"iss":            f.server.URL,
+		"sub":            "subject",
+		"aud":            testClientID,
+		"exp":            now.Add(time.Hour).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          nonce,
+		"email":          "alice@example.com",
+		"email_verified": true,
+	}
+}
+
+// Signs the claims with the key of kid. alg goes on the header as it is, so
+// it can lie about the key.
+func (f *fakeIssuer) sign(t *testing.T, kid string, alg string, claims map[string]any) string {
+	t.Helper()
+
+	f.mu.Lock()
+	key := f.keys[kid]
+	f.mu.Unlock()
+
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, hash[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, hash[:])
+		if err == nil {
+			sig = make([]byte, 64)
+			r.FillBytes(sig[:32])
+			s.FillBytes(sig[32:])
+		}
+	default:
+		t.Fatalf("no key `%s`", kid)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func publicJWK(kid string, key crypto.PublicKey) jwk {
+	encode := base64.RawURLEncoding.EncodeToString
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return jwk{Kid: kid, Kty: "RSA", Use: "sig", Alg: "RS256", N: encode(k.N.Bytes()), E: encode(big.NewInt(int64(k.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		x, y := make([]byte, 32), make([]byte, 32)
+		k.X.FillBytes(x)
+		k.Y.FillBytes(y)
+		return jwk{Kid: kid, Kty: "EC", Use: "sig", Alg: "ES256", Crv: "P-256", X: encode(x), Y: encode(y)}
+	}
+
+	panic("unreachable error on oidc_test.go: unknown key type")
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	f := newFakeIssuer(t)
+	f.addKey(t, "rsa", "RS256")
+	f.addKey(t, "ec", "ES256")
+	p := f.provider(t)
+
+	cases := []struct {
+		name   string
+		kid    string
+		alg    string
+		tamper func(claims map[string]any)
+		valid  bool
+	}{
+		{name: "RS256", kid: "rsa", alg: "RS256", valid: true},
+		{name: "ES256", kid: "ec", alg: "ES256", valid: true},
+		{name: "audience list with azp", kid: "rsa", alg: "RS256", valid: true, tamper: func(c map[string]any) {
+			c["aud"] = []string{testClientID, "other"}
+			c["azp"] = testClientID
+		}},
+		{name: "expired within the leeway", kid: "rsa", alg: "RS256", valid: true, tamper: func(c map[string]any) {
+			c["exp"] = time.Now().Add(-idTokenLeeway / 2).Unix()
+		}},
+		{name: "nonce mismatch", kid: "rsa", alg: "RS256", tamper: func(c map[string]any) {
+			c["nonce"] = "other"
+		}},
+		{name: "wrong audience", kid: "rsa", alg: "RS256", tamper: func(c map[string]any) {
+			c["aud"] = "other"
+		}},
+		{name: "audience list without azp", kid: "rsa", alg: "RS256", tamper: func(c map[string]any) {
+			c["aud"] = []string{testClientID, "other"}
+		}},
+		{name: "wrong azp", kid: "rsa", alg: "RS256", tamper: func(c map[string]any) {
+			c["aud"] = []string{testClientID, "other"}
+			c["azp"] = "other"
+		}},
+		{name: "expired", kid: "rsa", alg: "RS256", tamper: func(c map[string]any) {
+			c["exp"] = time.Now().Add(-2 * idTokenLeeway).Unix()
+		}},
+		{name: "issued in the future", kid: "rsa", alg: "RS256", tamper: func(c map[string]any) {
+			c["iat"] = time.Now().Add(2 * idTokenLeeway).Unix()
+		}},
+		{name: "wrong issuer", kid: "rsa", alg: "RS256", tamper: func(c map[string]any) {
+			c["iss"] = "https://evil.example.com"
+		}},
+		{name: "RS384", kid: "rsa", alg: "RS384"},
+		{name: "HS256", kid: "rsa", alg: "HS256"},
+		{name: "none", kid: "rsa", alg: "none"},
+		{name: "alg of another key type", kid: "rsa", alg: "ES256"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			claims := f.claims("nonce")
+			if c.tamper != nil {
+				c.tamper(claims)
+			}
+
+			got, err := p.VerifyIDToken(context.Background(), f.sign(t, c.kid, c.alg, claims), "nonce", time.Now())
+			if c.valid {
+				if err != nil {
+					t.Fatalf("got %v, want a valid token", err)
+				}
+				if got.Subject != "subject" || got.Email != "alice@example.com" || !bool(got.EmailVerified) {
+					t.Errorf("got claims %+v", got)
+				}
+			} else if !errors.Is(err, ErrInvalidIDToken) {
+				t.Errorf("got %v, want ErrInvalidIDToken", err)
+			}
+		})
+	}
+
+	t.Run("bad signature", func(t *testing.T) {
+		token := f.sign(t, "rsa", "RS256", f.claims("nonce"))
+		other := f.sign(t, "rsa", "RS256", f.claims("other"))
+		forged := token[:strings.LastIndex(token, ".")] + other[strings.LastIndex(other, "."):]
+
+		_, err := p.VerifyIDToken(context.Background(), forged, "nonce", time.Now())
+		if !errors.Is(err, ErrInvalidIDToken) {
+			t.Errorf("got %v, want ErrInvalidIDToken", err)
+		}
+	})
+}
+
+func TestVerifyIDTokenRefetchesUnknownKeys(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeIssuer(t)
+	f.addKey(t, "old", "RS256")
+	p := f.provider(t)
+
+	_, err := p.VerifyIDToken(ctx, f.sign(t, "old", "RS256", f.claims("nonce")), "nonce", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A rotation right after a fetch has to wait, otherwise tokens with random
+	// key ids would make us fetch the keys every time.
+	f.addKey(t, "new", "ES256")
+	_, err = p.VerifyIDToken(ctx, f.sign(t, "new", "ES256", f.claims("nonce")), "nonce", time.Now())
+	if !errors.Is(err, ErrInvalidIDToken) {
+		t.Fatalf("got %v, want ErrInvalidIDToken", err)
+	}
+	if f.jwks_fetches != 1 {
+		t.Fatalf("keys fetched %d times, want 1", f.jwks_fetches)
+	}
+
+	p.keys.last_fetch = time.Now().Add(-2 * time.Minute)
+	_, err = p.VerifyIDToken(ctx, f.sign(t, "new", "ES256", f.claims("nonce")), "nonce", time.Now())
+	if err != nil {
+		t.Fatalf("got %v after the keys could be fetched again", err)
+	}
+	if f.jwks_fetches != 2 {
+		t.Errorf("keys fetched %d times, want 2", f.jwks_fetches)
+	}
+
+	// Known keys don't cost a fetch.
+	_, err = p.VerifyIDToken(ctx, f.sign(t, "old", "RS256", f.claims("nonce")), "nonce", time.Now())
+	if err != nil || f.jwks_fetches != 2 {
+		t.Errorf("got %v with %d fetches, want the cached key", err, f.jwks_fetches)
+	}
+}
+
+func TestOIDCRoute(t *testing.T) {
+	f := newFakeIssuer(t)
+	f.addKey(t, "rsa", "RS256")
+	providers := NewOIDCRegistry()
+	providers.Register(f.provider(t))
+
+	sm := NewSessionManager[string](NewMemoryStore(), func(u string) string { return u })
+	router := chi.NewRouter()
+	sm.OIDCRoute(router, providers, func(r *http.Request, provider string, claims *IDTokenClaims) (*string, error) {
+		user := provider + ":" + claims.Subject
+		return &user, nil
+	})
+
+	// Starts a login, returning the cookie of the flow and the parameters sent
+	// to the provider.
+	start := func(t *testing.T) (*http.Cookie, url.Values) {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/login/oidc/fake?next=/posts", nil))
+		if w.Code != http.StatusFound {
+			t.Fatalf("login got status %d", w.Code)
+		}
+		location, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		params := location.Query()
+
+		f.mu.Lock()
+		f.challenge = params.Get("code_challenge")
+		f.mu.Unlock()
+		for _, c := range w.Result().Cookies() {
+			if c.Name == "oidc" {
+				return c, params
+			}
+		}
+		t.Fatal("login didn't set the oidc cookie")
+		return nil, nil
+	}
+	callback := func(cookie *http.Cookie, state string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/login/oidc/fake/callback?code=code&state="+url.QueryEscape(state), nil)
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("logs in", func(t *testing.T) {
+		cookie, params := start(t)
+		f.respondWith(func() string { return f.sign(t, "rsa", "RS256", f.claims(params.Get("nonce"))) })
+
+		w := callback(cookie, params.Get("state"))
+		if w.Code != http.StatusOK {
+			t.Fatalf("callback got status %d: %s", w.Code, w.Body)
+		}
+		logged := false
+		for _, c := range w.Result().Cookies() {
+			logged = logged || (c.Name == "id" && c.Value != "")
+		}
+		if !logged {
+			t.Error("callback didn't start a session")
+		}
+
+		// The flow is gone, the callback can't be replayed.
+		w = callback(cookie, params.Get("state"))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("replayed callback got status %d, want 400", w.Code)
+		}
+	})
+
+	t.Run("state mismatch", func(t *testing.T) {
+		cookie, params := start(t)
+		f.respondWith(func() string { return f.sign(t, "rsa", "RS256", f.claims(params.Get("nonce"))) })
+
+		w := callback(cookie, "forged")
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("got status %d, want 400", w.Code)
+		}
+	})
+
+	t.Run("nonce mismatch", func(t *testing.T) {
+		cookie, params := start(t)
+		f.respondWith(func() string { return f.sign(t, "rsa", "RS256", f.claims("forged")) })
+
+		w := callback(cookie, params.Get("state"))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("got status %d, want 403", w.Code)
+		}
+	})
+}
@@ -0,0 +1,65 @@
+package services
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+// Allows up to `limit` events per key in each window of time, e.g. 5 password
+// resets per email every hour. Counters live in memory, so each instance of
+// the app counts on its own.
+type RateLimiter struct {
+	limit  int
+	window time.Duration
+
+	mu         sync.Mutex
+	windows    map[string]rateWindow
+	last_purge time.Time
+}
+
+func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
+	return &RateLimiter{limit: limit, window: window, windows: make(map[string]rateWindow)}
+}
+
+// Counts an event for the key, reporting if it's still under the limit.
+func (rl *RateLimiter) Allow(key string) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(rl.last_purge) >= rl.window {
+		for k, w := range rl.windows {
+			if now.Sub(w.start) >= rl.window {
+				delete(rl.windows, k)
+			}
+		}
+		rl.last_purge = now
+	}
+
+	w, ok := rl.windows[key]
+	if !ok || now.Sub(w.start) >= rl.window {
+		w = rateWindow{start: now}
+	}
+	w.count++
+	rl.windows[key] = w
+
+	return w.count <= rl.limit
+}
+
+// Address of the client without the port. Put a middleware such as chi's
+// RealIP in front when running behind a proxy.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
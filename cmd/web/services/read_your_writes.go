@@ -0,0 +1,41 @@
+package services
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/robertoesteves13/go-template/internal"
+)
+
+// Cookie that pins the requests of a client to the primary database.
+const readYourWritesCookie = "db_primary"
+
+// Middleware that sends the queries of requests that write to the primary
+// database, and keeps the following requests of the same client there for
+// `window`, so they see their own changes while the replicas catch up. Use the
+// maximum replica lag as the window.
+func ReadYourWrites(window time.Duration) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			pinned := false
+			if !isSafeMethod(r.Method) {
+				http.SetCookie(w, &http.Cookie{
+					Name:     readYourWritesCookie,
+					Value:    "1",
+					Path:     "/",
+					MaxAge:   int(window.Seconds()) + 1,
+					HttpOnly: true,
+					SameSite: http.SameSiteLaxMode,
+				})
+				pinned = true
+			} else if _, err := r.Cookie(readYourWritesCookie); err == nil {
+				pinned = true
+			}
+
+			if pinned {
+				r = r.WithContext(internal.WithIntent(r.Context(), internal.IntentWrite))
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
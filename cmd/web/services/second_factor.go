@@ -0,0 +1,134 @@
+package services
+
+import (
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Implemented by user types that support a second authentication step, such
+// as TOTP. When it reports true, LoginRoute creates a pending session that
+// only becomes a real one after SecondFactorRoute accepts a code.
+type SecondFactorRequirer interface {
+	RequiresSecondFactor() bool
+}
+
+const (
+	// How long the user has to send the code after the password.
+	pendingSessionTimeout = 5 * time.Minute
+	// Wrong codes accepted before the pending session is thrown away and the
+	// user has to start over from the password.
+	maxSecondFactorAttempts = 5
+)
+
+func requiresSecondFactor[User any](u User) bool {
+	if sf, ok := any(u).(SecondFactorRequirer); ok {
+		return sf.RequiresSecondFactor()
+	}
+	if sf, ok := any(&u).(SecondFactorRequirer); ok {
+		return sf.RequiresSecondFactor()
+	}
+
+	return false
+}
+
+// Path of the page asking for the second factor, keeping where the user
+// wanted to go.
+func secondFactorURL(next string, invalid bool) string {
+	params := url.Values{}
+	if next != "" {
+		params.Set("next", next)
+	}
+	if invalid {
+		params.Set("invalid", "1")
+	}
+	if len(params) == 0 {
+		return "/login/2fa"
+	}
+
+	return "/login/2fa?" + params.Encode()
+}
+
+type verifyFunc[User any] func(*http.Request, User) (bool, error)
+
+// Registers `POST /login/2fa`, which completes a login that is waiting for
+// the second factor. vf checks the code sent by the user, returning a
+// ThrottledError when the client must wait, which is answered with 429 and
+// doesn't count as a wrong code. On success the session is rotated and
+// becomes a regular one, otherwise the user is sent back to `GET /login/2fa`
+// with `invalid=1`, which the app must provide.
+func (sm *SessionManager[User]) SecondFactorRoute(router chi.Router, vf verifyFunc[User]) {
+	router.Post("/login/2fa", func(w http.ResponseWriter, r *http.Request) {
+		next := r.FormValue("next")
+		session_id, err := r.Cookie("id")
+		if err != nil {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+
+		ctx := r.Context()
+		info, err := sm.getSessionInfo(ctx, session_id.Value)
+		if errors.Is(err, ErrSessionNotFound) || (err == nil && sm.timeLeft(info, time.Now()) <= 0) {
+			sm.clearCookie(w)
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		} else if err != nil {
+			log.Printf("%v", err)
+			sm.renderError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		if !info.PendingSecondFactor {
+			http.Redirect(w, r, safeRedirect(next), http.StatusSeeOther)
+			return
+		}
+
+		ok, err := vf(r, info.User)
+		if throttled := (*ThrottledError)(nil); errors.As(err, &throttled) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(throttled.RetryAfter.Seconds()))))
+			sm.renderError(w, r, http.StatusTooManyRequests, throttled)
+			return
+		} else if err != nil {
+			log.Printf("%v", err)
+			sm.renderError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		if !ok {
+			info.FailedAttempts++
+			if info.FailedAttempts >= maxSecondFactorAttempts {
+				sm.destroySession(ctx, session_id.Value)
+				sm.clearCookie(w)
+				http.Redirect(w, r, "/login", http.StatusSeeOther)
+				return
+			}
+
+			err = sm.replaceSession(ctx, session_id.Value, info)
+			if err != nil {
+				log.Printf("%v", err)
+			}
+			http.Redirect(w, r, secondFactorURL(next, true), http.StatusSeeOther)
+			return
+		}
+
+		err = sm.rotateSession(w, r, func(info *SessionInfo[User]) {
+			now := time.Now()
+			info.PendingSecondFactor = false
+			info.FailedAttempts = 0
+			info.CreatedAt = now
+			info.LastSeenAt = now
+		})
+		if err != nil {
+			log.Printf("%v", err)
+			sm.renderError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		http.Redirect(w, r, safeRedirect(next), http.StatusSeeOther)
+	})
+}
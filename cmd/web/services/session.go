@@ -6,12 +6,15 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/bradfitz/gomemcache/memcache"
 	"github.com/go-chi/chi/v5"
 )
 
@@ -19,6 +22,8 @@ type SessionKey int
 
 const (
 	UserSession SessionKey = iota
+	CSRFToken
+	FlashMessages
 )
 
 func GetUserSession[User any](ctx context.Context) *SessionInfo[User] {
@@ -30,79 +35,323 @@ func GetUserSession[User any](ctx context.Context) *SessionInfo[User] {
 }
 
 type SessionInfo[User any] struct {
-	User         User
-	CreatedAt   time.Time
-	TimeToLive time.Duration
+	User       User
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	CSRFToken  string
+	// The password was right but the second factor wasn't sent yet. Pending
+	// sessions don't log the user in, see SecondFactorRoute.
+	PendingSecondFactor bool
+	FailedAttempts      int
+	// Waiting for the next page, see AddFlash.
+	Flashes []Flash
 }
 
 type SessionManager[User any] struct {
-	servers []string
+	store   SessionStore
+	userKey func(User) string
+
+	absoluteTimeout  time.Duration
+	idleTimeout      time.Duration
+	renewalThreshold time.Duration
+	signingKey       []byte
+	renderError      ErrorRenderer
 }
 
-func NewSessionManager[User any](servers ...string) (*SessionManager[User], error) {
-	mc := memcache.New(servers...)
-	err := mc.Ping()
-	if err != nil {
-		return nil, fmt.Errorf("failed to ping memcache: [%v]", err)
+type SessionOption func(*sessionConfig)
+
+type sessionConfig struct {
+	absoluteTimeout  time.Duration
+	idleTimeout      time.Duration
+	renewalThreshold time.Duration
+	signingKey       []byte
+	renderError      ErrorRenderer
+}
+
+// Maximum lifetime of a session, no matter how active the user is. Defaults to
+// 7 days.
+func WithAbsoluteTimeout(d time.Duration) SessionOption {
+	return func(c *sessionConfig) {
+		c.absoluteTimeout = d
+	}
+}
+
+// How long a session survives without any request. Defaults to 24 hours.
+func WithIdleTimeout(d time.Duration) SessionOption {
+	return func(c *sessionConfig) {
+		c.idleTimeout = d
+	}
+}
+
+// Minimum time between two renewals of the same session. Renewing writes to
+// the store and sends a new cookie, so doing it on every request is wasteful.
+// Defaults to 15 minutes.
+func WithRenewalThreshold(d time.Duration) SessionOption {
+	return func(c *sessionConfig) {
+		c.renewalThreshold = d
+	}
+}
+
+// Key of the signature of the cookies kept on the client, such as the flashes
+// of anonymous users. Every instance of the app must use the same key.
+// Defaults to a random one, so those cookies don't survive a restart.
+func WithSigningKey(key []byte) SessionOption {
+	return func(c *sessionConfig) {
+		c.signingKey = key
+	}
+}
+
+// Writes the error responses of the middlewares and routes of the session
+// manager. Below 500, err says what's wrong with the request, such as
+// ErrLoginRequired or a ThrottledError. Otherwise it's what failed on our
+// side, which was already logged and must not be shown to the client.
+type ErrorRenderer func(w http.ResponseWriter, r *http.Request, status int, err error)
+
+// How the middlewares and routes answer errors, so they can look like the
+// pages of the app. Defaults to a plain text response with the status.
+func WithErrorRenderer(fn ErrorRenderer) SessionOption {
+	return func(c *sessionConfig) {
+		c.renderError = fn
+	}
+}
+
+func plainTextError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	http.Error(w, strconv.Itoa(status)+" "+strings.ToLower(http.StatusText(status)), status)
+}
+
+// Creates a manager that persists the sessions in the given store. See
+// MemcacheStore, MemoryStore and PostgresStore for the available backends.
+//
+// userKey must return an unique and stable identifier for the user, it's used
+// to keep track of all sessions of an user so they can be revoked at once.
+func NewSessionManager[User any](store SessionStore, userKey func(User) string, opts ...SessionOption) *SessionManager[User] {
+	cfg := sessionConfig{
+		absoluteTimeout:  7 * 24 * time.Hour,
+		idleTimeout:      24 * time.Hour,
+		renewalThreshold: 15 * time.Minute,
+		renderError:      plainTextError,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if len(cfg.signingKey) == 0 {
+		cfg.signingKey = make([]byte, 32)
+		_, err := rand.Read(cfg.signingKey)
+		if err != nil {
+			panic("unreachable error on session.go: " + err.Error())
+		}
+	}
+
+	return &SessionManager[User]{
+		store:            store,
+		userKey:          userKey,
+		absoluteTimeout:  cfg.absoluteTimeout,
+		idleTimeout:      cfg.idleTimeout,
+		renewalThreshold: cfg.renewalThreshold,
+		signingKey:       cfg.signingKey,
+		renderError:      cfg.renderError,
 	}
+}
+
+func sessionKey(id string) string {
+	return "session:" + id
+}
 
-	return &SessionManager[User]{servers: servers}, nil
+func userSessionsKey(key string) string {
+	return "user_sessions:" + key
 }
 
-func (sm *SessionManager[User]) createSession(u User) (string, error) {
+func newSessionID() string {
 	b := make([]byte, 128)
 	_, err := rand.Read(b)
 	if err != nil {
 		panic("unreachable error on session.go: " + err.Error())
 	}
-	id := base64.URLEncoding.EncodeToString(b)
 
+	return base64.URLEncoding.EncodeToString(b)
+}
+
+func (sm *SessionManager[User]) createSession(ctx context.Context, u User, pending bool) (string, error) {
+	id := newSessionID()
+	now := time.Now()
 	info := SessionInfo[User]{
-		User:         u,
-		CreatedAt:   time.Now(),
-		TimeToLive: 24 * time.Hour,
+		User:                u,
+		CreatedAt:           now,
+		LastSeenAt:          now,
+		CSRFToken:           newCSRFToken(),
+		PendingSecondFactor: pending,
+	}
+	err := sm.saveSession(ctx, id, info)
+	if err != nil {
+		return "", err
+	}
+
+	err = sm.indexSession(ctx, sm.userKey(u), id, info.CreatedAt.Add(sm.absoluteTimeout), "")
+	if err != nil {
+		return "", fmt.Errorf("failed to index session: [%v]", err)
+	}
+
+	return id, nil
+}
+
+// Saves a session under a new id. Sessions that already exist must be saved
+// with replaceSession.
+func (sm *SessionManager[User]) saveSession(ctx context.Context, id string, info SessionInfo[User]) error {
+	data, err := encodeSession(info)
+	if err != nil {
+		return err
+	}
+
+	err = sm.store.Set(ctx, sessionKey(id), data, sm.timeLeft(info, time.Now()))
+	if err != nil {
+		return fmt.Errorf("failed to save session: [%v]", err)
+	}
+
+	return nil
+}
+
+// Writes back a session read earlier in the request. Returns
+// ErrSessionNotFound if it was rotated, revoked or logged out in the
+// meantime, instead of bringing it back.
+func (sm *SessionManager[User]) replaceSession(ctx context.Context, id string, info SessionInfo[User]) error {
+	data, err := encodeSession(info)
+	if err != nil {
+		return err
+	}
+
+	err = sm.store.Replace(ctx, sessionKey(id), data, sm.timeLeft(info, time.Now()))
+	if err != nil {
+		return fmt.Errorf("failed to save session: [%w]", err)
 	}
+
+	return nil
+}
+
+func encodeSession[User any](info SessionInfo[User]) ([]byte, error) {
 	buf := bytes.Buffer{}
 	enc := gob.NewEncoder(&buf)
-	err = enc.Encode(info)
+	err := enc.Encode(info)
 	if err != nil {
-		return "", fmt.Errorf("failed to encode session info: [%v]", err)
+		return nil, fmt.Errorf("failed to encode session info: [%v]", err)
 	}
 
-	mc := memcache.New(sm.servers...)
-	err = mc.Add(&memcache.Item{
-		Key:        id,
-		Value:      buf.Bytes(),
-		Expiration: int32(info.TimeToLive.Seconds()),
-	})
+	return buf.Bytes(), nil
+}
+
+// Time until the session expires, whichever timeout comes first.
+func (sm *SessionManager[User]) timeLeft(info SessionInfo[User], now time.Time) time.Duration {
+	idle := info.LastSeenAt.Add(sm.idleTimeout)
+	absolute := info.CreatedAt.Add(sm.absoluteTimeout)
+	if info.PendingSecondFactor {
+		absolute = info.CreatedAt.Add(pendingSessionTimeout)
+	}
+	if idle.Before(absolute) {
+		return idle.Sub(now)
+	}
 
+	return absolute.Sub(now)
+}
+
+// Loads the sessions of an user, mapping the session id to when it expires.
+func (sm *SessionManager[User]) userSessions(ctx context.Context, key string) (map[string]time.Time, error) {
+	sessions := make(map[string]time.Time)
+	data, err := sm.store.Get(ctx, userSessionsKey(key))
+	if errors.Is(err, ErrSessionNotFound) {
+		return sessions, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	err = dec.Decode(&sessions)
 	if err != nil {
-		return "", fmt.Errorf("failed to save to memcache: [%v]", err)
+		return nil, fmt.Errorf("failed to decode user sessions: [%v]", err)
 	}
 
-	return id, nil
+	return sessions, nil
+}
+
+// Adds the session to the user's index, dropping the ones that already
+// expired. If replaced isn't empty, that session is removed from the index.
+// The index lives as long as the newest session.
+//
+// The read-modify-write isn't atomic, so two logins of the same user at the
+// exact same time may lose one of the entries.
+func (sm *SessionManager[User]) indexSession(ctx context.Context, key string, id string, expires time.Time, replaced string) error {
+	sessions, err := sm.userSessions(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for sid, exp := range sessions {
+		if exp.Before(now) {
+			delete(sessions, sid)
+		}
+	}
+	if replaced != "" {
+		delete(sessions, replaced)
+	}
+	sessions[id] = expires
+
+	latest := expires
+	for _, exp := range sessions {
+		if exp.After(latest) {
+			latest = exp
+		}
+	}
+
+	buf := bytes.Buffer{}
+	enc := gob.NewEncoder(&buf)
+	err = enc.Encode(sessions)
+	if err != nil {
+		return fmt.Errorf("failed to encode user sessions: [%v]", err)
+	}
+
+	return sm.store.Set(ctx, userSessionsKey(key), buf.Bytes(), latest.Sub(now))
 }
 
-func (sm *SessionManager[User]) destroySession(id string) error {
-	mc := memcache.New(sm.servers...)
-	err := mc.Delete(id)
+// Destroys every session of the user, logging them out of all devices. Call
+// this after sensitive changes to the account, such as a new password.
+func (sm *SessionManager[User]) RevokeUserSessions(ctx context.Context, u User) error {
+	key := sm.userKey(u)
+	sessions, err := sm.userSessions(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to get user sessions: [%v]", err)
+	}
+
+	for id := range sessions {
+		err := sm.destroySession(ctx, id)
+		if err != nil && !errors.Is(err, ErrSessionNotFound) {
+			return err
+		}
+	}
+
+	err = sm.store.Delete(ctx, userSessionsKey(key))
+	if err != nil && !errors.Is(err, ErrSessionNotFound) {
+		return fmt.Errorf("failed to delete user sessions: [%v]", err)
+	}
+
+	return nil
+}
 
+func (sm *SessionManager[User]) destroySession(ctx context.Context, id string) error {
+	err := sm.store.Delete(ctx, sessionKey(id))
 	if err != nil {
-		return fmt.Errorf("failed to destroy session: [%v]", err)
+		return fmt.Errorf("failed to destroy session: [%w]", err)
 	}
 
 	return nil
 }
 
-func (sm *SessionManager[User]) getSessionInfo(id string) (SessionInfo[User], error) {
+func (sm *SessionManager[User]) getSessionInfo(ctx context.Context, id string) (SessionInfo[User], error) {
 	var info SessionInfo[User]
-	mc := memcache.New(sm.servers...)
-	item, err := mc.Get(id)
+	data, err := sm.store.Get(ctx, sessionKey(id))
 	if err != nil {
-		return info, fmt.Errorf("failed to get session: [%v]", err)
+		return info, fmt.Errorf("failed to get session: [%w]", err)
 	}
 
-	dec := gob.NewDecoder(bytes.NewReader(item.Value))
+	dec := gob.NewDecoder(bytes.NewReader(data))
 	err = dec.Decode(&info)
 	if err != nil {
 		return info, fmt.Errorf("failed to decode session: [%v]", err)
@@ -111,36 +360,209 @@ func (sm *SessionManager[User]) getSessionInfo(id string) (SessionInfo[User], er
 	return info, nil
 }
 
+// Changes the session of the request in place, keeping its id and expiration.
+// Returns ErrSessionNotFound if the session is gone, even if it was rotated or
+// revoked after being read.
+func (sm *SessionManager[User]) updateSession(r *http.Request, update func(*SessionInfo[User])) error {
+	session_id, err := r.Cookie("id")
+	if err != nil {
+		return ErrSessionNotFound
+	}
+
+	info, err := sm.getSessionInfo(r.Context(), session_id.Value)
+	if err != nil {
+		return err
+	}
+	update(&info)
+
+	return sm.replaceSession(r.Context(), session_id.Value, info)
+}
+
+// The attributes must be the same on every cookie operation, otherwise the
+// browser may keep the old cookie around when we try to clear it.
+func (sm *SessionManager[User]) setCookie(w http.ResponseWriter, id string, max_age time.Duration) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "id",
+		Value:    id,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+		// TODO: uncomment when http2 is supported
+		// Secure: true,
+		MaxAge: int(max_age.Seconds()),
+	})
+}
+
+func (sm *SessionManager[User]) clearCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "id",
+		Value:    "",
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+		MaxAge:   -1,
+	})
+}
+
+// Passed to the failure handler of LoginRoute when the credentials are wrong.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
 type validateFunc[User any] func(*http.Request) (*User, error)
 
-func (sm *SessionManager[User]) LoginRoute(router chi.Router, vf validateFunc[User]) {
+type loginFailedFunc func(w http.ResponseWriter, r *http.Request, err error)
+
+// Registers `POST /login`. The validator returns nil without an error for
+// wrong credentials, and a ThrottledError when the client must wait. Both
+// cases are answered by ff, which gets ErrInvalidCredentials or the
+// ThrottledError and must write the whole response, status included.
+func (sm *SessionManager[User]) LoginRoute(router chi.Router, vf validateFunc[User], ff loginFailedFunc) {
 	router.Post("/login", func(w http.ResponseWriter, r *http.Request) {
+		sm.dropSession(w, r)
+
 		if user, err := vf(r); user != nil {
-			id, err := sm.createSession(*user)
+			// 303 so the browser doesn't resend the login form, which carries
+			// the CSRF token of the anonymous user.
+			location, err := sm.startSession(w, r, *user, r.FormValue("next"))
 			if err != nil {
 				log.Printf("%v", err)
-				http.Error(w, "internal server error", http.StatusInternalServerError)
+				sm.renderError(w, r, http.StatusInternalServerError, err)
 				return
 			}
-
-			http.SetCookie(w, &http.Cookie{
-				Name:     "id",
-				Value:    id,
-				Path:     "/",
-				HttpOnly: true,
-				SameSite: http.SameSiteStrictMode,
-				// TODO: uncomment when http2 is supported
-				// Secure: true,
-				MaxAge: 3600 * 24,
-			})
-
-			http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+			http.Redirect(w, r, location, http.StatusSeeOther)
+		} else if throttled := (*ThrottledError)(nil); errors.As(err, &throttled) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(throttled.RetryAfter.Seconds()))))
+			ff(w, r, throttled)
 		} else if err != nil {
 			log.Printf("%v", err)
-			http.Error(w, "500 internal server error", http.StatusInternalServerError)
+			sm.renderError(w, r, http.StatusInternalServerError, err)
 		} else {
-			http.Error(w, "403 forbidden", http.StatusForbidden)
+			ff(w, r, ErrInvalidCredentials)
+		}
+	})
+}
+
+// Never reuse an id the client already had, otherwise an attacker could plant
+// a known id and wait for the victim to login with it.
+func (sm *SessionManager[User]) dropSession(w http.ResponseWriter, r *http.Request) {
+	if session_id, err := r.Cookie("id"); err == nil {
+		err := sm.destroySession(r.Context(), session_id.Value)
+		if err != nil && !errors.Is(err, ErrSessionNotFound) {
+			log.Printf("%v", err)
 		}
+		sm.clearCookie(w)
+	}
+}
+
+// Creates the session of an user that just proved who they are, returning
+// where to send them: `next`, or the second factor page if it's required.
+func (sm *SessionManager[User]) startSession(w http.ResponseWriter, r *http.Request, u User, next string) (string, error) {
+	pending := requiresSecondFactor(u)
+	id, err := sm.createSession(r.Context(), u, pending)
+	if err != nil {
+		return "", err
+	}
+
+	if pending {
+		sm.setCookie(w, id, pendingSessionTimeout)
+		return secondFactorURL(next, false), nil
+	}
+	sm.setCookie(w, id, sm.idleTimeout)
+	return safeRedirect(next), nil
+}
+
+// Moves the current session to a new id, keeping all of its data, and sends
+// the new cookie to the client. Call it whenever the privileges of the user
+// change, so an id leaked before the change becomes useless.
+//
+// The new session is saved before the old one is deleted, so the user is
+// never left without a valid session if something fails in between.
+func (sm *SessionManager[User]) RotateSession(w http.ResponseWriter, r *http.Request) error {
+	return sm.rotateSession(w, r, func(*SessionInfo[User]) {})
+}
+
+// Replaces the user kept in the current session, for when the account changed
+// after login (e.g. the email was verified). The session is rotated as well,
+// since that usually changes what the user can do.
+func (sm *SessionManager[User]) UpdateSessionUser(w http.ResponseWriter, r *http.Request, u User) error {
+	return sm.rotateSession(w, r, func(info *SessionInfo[User]) {
+		info.User = u
+	})
+}
+
+func (sm *SessionManager[User]) rotateSession(w http.ResponseWriter, r *http.Request, update func(*SessionInfo[User])) error {
+	session_id, err := r.Cookie("id")
+	if err != nil {
+		return ErrSessionNotFound
+	}
+
+	ctx := r.Context()
+	old_id := session_id.Value
+	info, err := sm.getSessionInfo(ctx, old_id)
+	if err != nil {
+		return err
+	}
+
+	id := newSessionID()
+	update(&info)
+	info.CSRFToken = newCSRFToken()
+	// The Flashes middleware of this request already holds them, and saves
+	// them again once the response starts.
+	info.Flashes = nil
+	err = sm.saveSession(ctx, id, info)
+	if err != nil {
+		return err
+	}
+
+	err = sm.indexSession(ctx, sm.userKey(info.User), id, info.CreatedAt.Add(sm.absoluteTimeout), old_id)
+	if err != nil {
+		sm.destroySession(ctx, id)
+		return fmt.Errorf("failed to index session: [%v]", err)
+	}
+
+	err = sm.destroySession(ctx, old_id)
+	if err != nil && !errors.Is(err, ErrSessionNotFound) {
+		log.Printf("failed to delete rotated session: %v", err)
+	}
+
+	sm.setCookie(w, id, sm.timeLeft(info, time.Now()))
+	return nil
+}
+
+// Pushes the idle timeout forward, both on the store and on the cookie.
+// Returns ErrSessionNotFound if the session was destroyed after it was read,
+// such as by a rotation or RevokeUserSessions. Any other failure isn't fatal,
+// the session is still valid until it expires.
+func (sm *SessionManager[User]) renewSession(ctx context.Context, w http.ResponseWriter, id string, info SessionInfo[User], now time.Time) (SessionInfo[User], error) {
+	renewed := info
+	renewed.LastSeenAt = now
+	err := sm.replaceSession(ctx, id, renewed)
+	if errors.Is(err, ErrSessionNotFound) {
+		return info, err
+	} else if err != nil {
+		log.Printf("failed to renew session: %v", err)
+		return info, nil
+	}
+
+	sm.setCookie(w, id, sm.timeLeft(renewed, now))
+	return renewed, nil
+}
+
+// Registers `POST /logout`, which destroys the current session and redirects
+// to the home page.
+func (sm *SessionManager[User]) LogoutRoute(router chi.Router) {
+	router.Post("/logout", func(w http.ResponseWriter, r *http.Request) {
+		if session_id, err := r.Cookie("id"); err == nil {
+			err := sm.destroySession(r.Context(), session_id.Value)
+			if err != nil && !errors.Is(err, ErrSessionNotFound) {
+				log.Printf("%v", err)
+				sm.renderError(w, r, http.StatusInternalServerError, err)
+				return
+			}
+		}
+
+		sm.clearCookie(w)
+		AddFlash(w, r, FlashInfo, "You logged out")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
 	})
 }
 
@@ -150,17 +572,21 @@ func (sm *SessionManager[User]) Authenticate(h http.Handler) http.Handler {
 		ctx := r.Context()
 		if err == nil {
 			id := session_id.Value
-			info, err := sm.getSessionInfo(id)
+			info, err := sm.getSessionInfo(ctx, id)
 			if err == nil {
-				if info.CreatedAt.Add(info.TimeToLive).Before(time.Now()) {
-					sm.destroySession(id)
-					http.SetCookie(w, &http.Cookie{
-						Name:   "id",
-						Value:  "",
-						MaxAge: -1,
-					})
-				} else {
-					ctx = context.WithValue(ctx, UserSession, info)
+				now := time.Now()
+				if sm.timeLeft(info, now) <= 0 {
+					sm.destroySession(ctx, id)
+					sm.clearCookie(w)
+				} else if !info.PendingSecondFactor {
+					if now.Sub(info.LastSeenAt) >= sm.renewalThreshold {
+						info, err = sm.renewSession(ctx, w, id, info, now)
+					}
+					if err == nil {
+						ctx = context.WithValue(ctx, UserSession, info)
+					} else {
+						sm.clearCookie(w)
+					}
 				}
 			}
 		}
@@ -0,0 +1,122 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Returned by a SessionStore when the key doesn't exist or has expired.
+var ErrSessionNotFound = errors.New("session not found")
+
+// Backend where the SessionManager keeps the encoded session data. Values are
+// opaque to the store, it only has to keep them until the TTL runs out.
+type SessionStore interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Like Set, but only if the key still exists, returning ErrSessionNotFound
+	// otherwise. The check and the write must be atomic, so a session that was
+	// deleted in the meantime isn't brought back.
+	Replace(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Delete(ctx context.Context, key string) error
+}
+
+type memoryItem struct {
+	value     []byte
+	expiresAt time.Time
+}
+
+// Store that keeps everything in the process memory. Useful for tests and
+// deployments running a single instance, since nothing is shared between
+// replicas and all sessions are lost on restart.
+type MemoryStore struct {
+	mu        sync.Mutex
+	items     map[string]memoryItem
+	lastPurge time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{items: make(map[string]memoryItem)}
+}
+
+func (ms *MemoryStore) Get(ctx context.Context, key string) ([]byte, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	item, ok := ms.items[key]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+
+	if !item.expiresAt.After(time.Now()) {
+		delete(ms.items, key)
+		return nil, ErrSessionNotFound
+	}
+
+	value := make([]byte, len(item.value))
+	copy(value, item.value)
+	return value, nil
+}
+
+func (ms *MemoryStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.purge()
+	stored := make([]byte, len(value))
+	copy(stored, value)
+	ms.items[key] = memoryItem{
+		value:     stored,
+		expiresAt: time.Now().Add(ttl),
+	}
+
+	return nil
+}
+
+func (ms *MemoryStore) Delete(ctx context.Context, key string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.items[key]; !ok {
+		return ErrSessionNotFound
+	}
+	delete(ms.items, key)
+
+	return nil
+}
+
+func (ms *MemoryStore) Replace(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	item, ok := ms.items[key]
+	if !ok || !item.expiresAt.After(time.Now()) {
+		return ErrSessionNotFound
+	}
+	stored := make([]byte, len(value))
+	copy(stored, value)
+	ms.items[key] = memoryItem{
+		value:     stored,
+		expiresAt: time.Now().Add(ttl),
+	}
+
+	return nil
+}
+
+// Removes expired items so the map doesn't grow forever with sessions that
+// were never read again. Runs at most once per minute and must be called with
+// the lock held.
+func (ms *MemoryStore) purge() {
+	now := time.Now()
+	if now.Sub(ms.lastPurge) < time.Minute {
+		return
+	}
+	ms.lastPurge = now
+
+	for key, item := range ms.items {
+		if !item.expiresAt.After(now) {
+			delete(ms.items, key)
+		}
+	}
+}
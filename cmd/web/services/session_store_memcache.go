@@ -0,0 +1,86 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// Store backed by one or more memcached servers. The client keeps its own
+// connection pool, so a single store should be shared by the whole app.
+type MemcacheStore struct {
+	mc *memcache.Client
+}
+
+func NewMemcacheStore(servers ...string) (*MemcacheStore, error) {
+	mc := memcache.New(servers...)
+	err := mc.Ping()
+	if err != nil {
+		return nil, fmt.Errorf("failed to ping memcache: [%v]", err)
+	}
+
+	return &MemcacheStore{mc: mc}, nil
+}
+
+func (ms *MemcacheStore) Get(ctx context.Context, key string) ([]byte, error) {
+	item, err := ms.mc.Get(key)
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return nil, ErrSessionNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get from memcache: [%v]", err)
+	}
+
+	return item.Value, nil
+}
+
+func (ms *MemcacheStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	err := ms.mc.Set(&memcache.Item{
+		Key:        key,
+		Value:      value,
+		Expiration: memcacheExpiration(ttl),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save to memcache: [%v]", err)
+	}
+
+	return nil
+}
+
+func (ms *MemcacheStore) Delete(ctx context.Context, key string) error {
+	err := ms.mc.Delete(key)
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return ErrSessionNotFound
+	} else if err != nil {
+		return fmt.Errorf("failed to delete from memcache: [%v]", err)
+	}
+
+	return nil
+}
+
+func (ms *MemcacheStore) Replace(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	err := ms.mc.Replace(&memcache.Item{
+		Key:        key,
+		Value:      value,
+		Expiration: memcacheExpiration(ttl),
+	})
+	if errors.Is(err, memcache.ErrNotStored) {
+		return ErrSessionNotFound
+	} else if err != nil {
+		return fmt.Errorf("failed to replace in memcache: [%v]", err)
+	}
+
+	return nil
+}
+
+// Memcache treats expirations longer than 30 days as an unix timestamp, so
+// those are converted to an absolute time.
+func memcacheExpiration(ttl time.Duration) int32 {
+	if ttl > 30*24*time.Hour {
+		return int32(time.Now().Add(ttl).Unix())
+	}
+
+	return int32(ttl.Seconds())
+}
@@ -0,0 +1,131 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/robertoesteves13/go-template/internal/database"
+)
+
+// Store that saves sessions in the `Sessions` table. It's slower than
+// memcache, but doesn't require another service to be running and survives
+// restarts. Expired rows are ignored on read and removed by DeleteExpired.
+type PostgresStore struct {
+	acquire func(context.Context) (*pgxpool.Conn, error)
+}
+
+// The acquire function is called for every operation, so the pool can be
+// connected after the store is created.
+func NewPostgresStore(acquire func(context.Context) (*pgxpool.Conn, error)) *PostgresStore {
+	return &PostgresStore{acquire: acquire}
+}
+
+func (ps *PostgresStore) Get(ctx context.Context, key string) ([]byte, error) {
+	conn, err := ps.acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get connection: [%v]", err)
+	}
+	defer conn.Release()
+
+	db := database.New(conn)
+	data, err := db.GetSession(ctx, database.GetSessionParams{
+		ID:  key,
+		Now: timestamp(time.Now()),
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrSessionNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get session: [%v]", err)
+	}
+
+	return data, nil
+}
+
+func (ps *PostgresStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	conn, err := ps.acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get connection: [%v]", err)
+	}
+	defer conn.Release()
+
+	db := database.New(conn)
+	err = db.SetSession(ctx, database.SetSessionParams{
+		ID:        key,
+		Data:      value,
+		ExpiresAt: timestamp(time.Now().Add(ttl)),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save session: [%v]", err)
+	}
+
+	return nil
+}
+
+func (ps *PostgresStore) Delete(ctx context.Context, key string) error {
+	conn, err := ps.acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get connection: [%v]", err)
+	}
+	defer conn.Release()
+
+	db := database.New(conn)
+	rows, err := db.DeleteSession(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to delete session: [%v]", err)
+	} else if rows == 0 {
+		return ErrSessionNotFound
+	}
+
+	return nil
+}
+
+func (ps *PostgresStore) Replace(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	conn, err := ps.acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get connection: [%v]", err)
+	}
+	defer conn.Release()
+
+	now := time.Now()
+	db := database.New(conn)
+	rows, err := db.ReplaceSession(ctx, database.ReplaceSessionParams{
+		Data:      value,
+		ExpiresAt: timestamp(now.Add(ttl)),
+		ID:        key,
+		Now:       timestamp(now),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to replace session: [%v]", err)
+	} else if rows == 0 {
+		return ErrSessionNotFound
+	}
+
+	return nil
+}
+
+// Removes every expired session from the table. It's not called by the store
+// itself, so run it periodically if the table grows too much.
+func (ps *PostgresStore) DeleteExpired(ctx context.Context) error {
+	conn, err := ps.acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get connection: [%v]", err)
+	}
+	defer conn.Release()
+
+	db := database.New(conn)
+	err = db.DeleteExpiredSessions(ctx, timestamp(time.Now()))
+	if err != nil {
+		return fmt.Errorf("failed to delete expired sessions: [%v]", err)
+	}
+
+	return nil
+}
+
+func timestamp(t time.Time) pgtype.Timestamp {
+	return pgtype.Timestamp{Time: t.UTC(), Valid: true}
+}
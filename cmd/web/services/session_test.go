@@ -0,0 +1,127 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Runs afterGet once, right after the first session is read, to act like a
+// request that changes it concurrently.
+type racingStore struct {
+	SessionStore
+	afterGet func()
+}
+
+func (rs *racingStore) Get(ctx context.Context, key string) ([]byte, error) {
+	value, err := rs.SessionStore.Get(ctx, key)
+	if f := rs.afterGet; f != nil && strings.HasPrefix(key, sessionKey("")) {
+		rs.afterGet = nil
+		f()
+	}
+
+	return value, err
+}
+
+func TestRenewalDoesNotRestoreRevokedSessions(t *testing.T) {
+	ctx := context.Background()
+	store := &racingStore{SessionStore: NewMemoryStore()}
+	sm := NewSessionManager(store, func(u string) string { return u }, WithRenewalThreshold(0))
+
+	id, err := sm.createSession(ctx, "alice", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.afterGet = func() {
+		err := sm.RevokeUserSessions(ctx, "alice")
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	logged := true
+	h := sm.Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logged = GetUserSession[string](r.Context()) != nil
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: "id", Value: id})
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	if logged {
+		t.Error("request went on with a revoked session")
+	}
+	_, err = store.SessionStore.Get(ctx, sessionKey(id))
+	if !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("revoked session is back after the renewal, got %v", err)
+	}
+}
+
+func TestMemoryStoreReplace(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+
+	err := store.Replace(ctx, "key", []byte("new"), time.Minute)
+	if !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("replacing a missing key got %v, want ErrSessionNotFound", err)
+	}
+	_, err = store.Get(ctx, "key")
+	if !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("replace created the key, got %v", err)
+	}
+
+	err = store.Set(ctx, "key", []byte("old"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Replace(ctx, "key", []byte("new"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := store.Get(ctx, "key")
+	if err != nil || string(value) != "new" {
+		t.Errorf("got %q, %v after the replace", value, err)
+	}
+}
+
+func TestSavingFlashesDoesNotRestoreRevokedSessions(t *testing.T) {
+	ctx := context.Background()
+	store := &racingStore{SessionStore: NewMemoryStore()}
+	sm := NewSessionManager(store, func(u string) string { return u })
+
+	id, err := sm.createSession(ctx, "alice", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := sm.Authenticate(sm.Flashes(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		AddFlash(w, r, FlashInfo, "Saved")
+		store.afterGet = func() {
+			err := sm.RevokeUserSessions(ctx, "alice")
+			if err != nil {
+				t.Error(err)
+			}
+		}
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	})))
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.AddCookie(&http.Cookie{Name: "id", Value: id})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	_, err = store.SessionStore.Get(ctx, sessionKey(id))
+	if !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("revoked session is back after saving the flashes, got %v", err)
+	}
+	// The flash isn't lost, it moves to the cookie.
+	saved := false
+	for _, c := range w.Result().Cookies() {
+		saved = saved || (c.Name == flashCookie && c.Value != "")
+	}
+	if !saved {
+		t.Error("flash wasn't saved on the cookie")
+	}
+}
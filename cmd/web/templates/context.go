@@ -1,6 +1,12 @@
 package templates
 
-import "context"
+import (
+	"context"
+	"encoding/json"
+
+	model "github.com/robertoesteves13/go-template"
+	"github.com/robertoesteves13/go-template/cmd/web/services"
+)
 
 // To setup some page data such as an title, it uses the context key/value
 // data structure so it avoids prop drilling and coupling. You can add more
@@ -31,3 +37,38 @@ func description(ctx context.Context) string {
 
 	return title
 }
+
+// The token is set by the CSRF middleware rather than by the handlers, so it
+// lives under the services context key.
+func csrfToken(ctx context.Context) string {
+	return services.GetCSRFToken(ctx)
+}
+
+// JSON for the `hx-headers` attribute, so every htmx request carries the
+// CSRF token.
+func csrfHeaders(ctx context.Context) string {
+	headers, err := json.Marshal(map[string]string{
+		services.CSRFHeader: csrfToken(ctx),
+	})
+	if err != nil {
+		return "{}"
+	}
+
+	return string(headers)
+}
+
+// Flashes are kept by the services middleware, reading them here marks them
+// as shown.
+func flashes(ctx context.Context) []services.Flash {
+	return services.GetFlashes(ctx)
+}
+
+// Logged user of the request, or nil for anonymous visitors.
+func currentUser(ctx context.Context) *model.User {
+	info := services.GetUserSession[model.User](ctx)
+	if info == nil {
+		return nil
+	}
+
+	return &info.User
+}
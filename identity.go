@@ -0,0 +1,136 @@
+package go_template
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+var (
+	// The email of the identity belongs to a local account that can't be
+	// linked automatically. The user must login to that account first.
+	ErrIdentityConflict = errors.New("email belongs to another account")
+	ErrMissingEmail     = errors.New("identity provider didn't share an email")
+	// New users need an email the provider verified, otherwise anyone could
+	// claim an address they don't own before its owner registers.
+	ErrUnverifiedEmail = errors.New("identity provider didn't verify the email")
+)
+
+// An account on an external identity provider linked to an user.
+type UserIdentity struct {
+	Provider string
+	// Id of the account on the provider, which never changes, unlike the
+	// email.
+	Subject   string
+	User      ulid.ULID
+	Email     string
+	CreatedAt time.Time
+}
+
+// What the identity provider says about the person logging in.
+type ExternalIdentity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// Finds the user of an external identity, linking or creating one on the first
+// login. An existing user with the same email is only linked when both the
+// provider and the app verified the address, otherwise whoever registered the
+// email first could take over the account of the other. New users are only
+// created for emails the provider verified, and have no password. Everything
+// runs in one transaction, so a failure never leaves an user without its
+// identity.
+func LoginWithIdentity(ctx context.Context, tx Transactor, ext ExternalIdentity, now time.Time) (*User, error) {
+	var user *User
+	err := tx.WithTx(ctx, func(repos TxRepositories) error {
+		var err error
+		user, err = findOrLinkIdentity(ctx, repos, ext, now)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func findOrLinkIdentity(ctx context.Context, repos TxRepositories, ext ExternalIdentity, now time.Time) (*User, error) {
+	id, err := repos.Identities.Find(ctx, ext.Provider, ext.Subject)
+	if err == nil {
+		return repos.Users.Get(ctx, id)
+	} else if !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+
+	if ext.Email == "" {
+		return nil, ErrMissingEmail
+	}
+
+	user, err := repos.Users.GetByEmail(ctx, ext.Email)
+	if errors.Is(err, ErrNotFound) {
+		if !ext.EmailVerified {
+			return nil, ErrUnverifiedEmail
+		}
+		user, err = newExternalUser(ctx, repos.Users, ext, now)
+		if err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	} else if !ext.EmailVerified || !user.IsVerified() {
+		return nil, ErrIdentityConflict
+	}
+
+	err = repos.Identities.Link(ctx, &UserIdentity{
+		Provider:  ext.Provider,
+		Subject:   ext.Subject,
+		User:      user.Id,
+		Email:     ext.Email,
+		CreatedAt: now,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func newExternalUser(ctx context.Context, users UserRepository, ext ExternalIdentity, now time.Time) (*User, error) {
+	user := &User{
+		Id:    ulid.Make(),
+		Email: ext.Email,
+		Role:  RoleUser,
+	}
+	user.Name = externalUsername(ext, user.Id)
+	err := users.Insert(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	err = users.MarkVerified(ctx, user, now)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// Providers accept any name, it's only kept if the register form would accept
+// it too. Otherwise the start of the email is tried, and at last a name made
+// from the id of the user.
+func externalUsername(ext ExternalIdentity, id ulid.ULID) string {
+	local, _, _ := strings.Cut(ext.Email, "@")
+	for _, name := range []string{ext.Name, local} {
+		if validateUsername(name) == "" {
+			return name
+		}
+	}
+
+	return "user-" + strings.ToLower(id.String()[ulid.EncodedSize-10:])
+}
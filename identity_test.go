@@ -0,0 +1,146 @@
+package go_template
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLoginWithIdentity(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	hasher, err := NewBcryptHasher(bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type setup struct {
+		users *MemoryUserRepository
+		tx    *MemoryTransactor
+		local *User
+	}
+	newSetup := func(t *testing.T, local_verified bool) setup {
+		t.Helper()
+		users := NewMemoryUserRepository()
+		local, err := NewUser("alice", "alice@example.com", "correct horse battery", hasher)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = users.Insert(ctx, local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if local_verified {
+			err = users.MarkVerified(ctx, local, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		tx := NewMemoryTransactor(users, NewMemoryPasswordResetRepository(), NewMemoryIdentityRepository())
+		return setup{users: users, tx: tx, local: local}
+	}
+
+	t.Run("links verified emails of verified users", func(t *testing.T) {
+		s := newSetup(t, true)
+		ext := ExternalIdentity{Provider: "google", Subject: "1", Email: s.local.Email, EmailVerified: true}
+
+		user, err := LoginWithIdentity(ctx, s.tx, ext, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Id != s.local.Id {
+			t.Errorf("got user %v, want the local one %v", user.Id, s.local.Id)
+		}
+	})
+
+	for name, c := range map[string]struct {
+		local_verified bool
+		ext_verified   bool
+	}{
+		"refuses unverified provider emails": {local_verified: true, ext_verified: false},
+		"refuses unverified local users":     {local_verified: false, ext_verified: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			s := newSetup(t, c.local_verified)
+			ext := ExternalIdentity{Provider: "google", Subject: "1", Email: s.local.Email, EmailVerified: c.ext_verified}
+
+			_, err := LoginWithIdentity(ctx, s.tx, ext, now)
+			if !errors.Is(err, ErrIdentityConflict) {
+				t.Errorf("got %v, want ErrIdentityConflict", err)
+			}
+		})
+	}
+
+	t.Run("creates users for unknown emails", func(t *testing.T) {
+		s := newSetup(t, true)
+		ext := ExternalIdentity{Provider: "google", Subject: "2", Email: "bob@example.com", EmailVerified: true}
+
+		user, err := LoginWithIdentity(ctx, s.tx, ext, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Id == s.local.Id || user.Name != "bob" || !user.IsVerified() {
+			t.Errorf("got %+v, want a new verified user named bob", user)
+		}
+
+		// The subject is what identifies the user from now on, even if the
+		// provider stops sharing the email.
+		again, err := LoginWithIdentity(ctx, s.tx, ExternalIdentity{Provider: "google", Subject: "2"}, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again.Id != user.Id {
+			t.Errorf("second login got user %v, want %v", again.Id, user.Id)
+		}
+	})
+
+	t.Run("refuses unverified emails of new users", func(t *testing.T) {
+		s := newSetup(t, true)
+		ext := ExternalIdentity{Provider: "gitlab", Subject: "3", Email: "carol@example.com", Name: "Carol"}
+
+		_, err := LoginWithIdentity(ctx, s.tx, ext, now)
+		if !errors.Is(err, ErrUnverifiedEmail) {
+			t.Errorf("got %v, want ErrUnverifiedEmail", err)
+		}
+		_, err = s.users.GetByEmail(ctx, ext.Email)
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("the unverified email was claimed, got %v", err)
+		}
+	})
+
+	t.Run("names new users like the register form", func(t *testing.T) {
+		s := newSetup(t, true)
+		cases := []struct {
+			ext  ExternalIdentity
+			name string
+		}{
+			{ExternalIdentity{Subject: "5", Email: "carol@example.com", Name: "Carol"}, "Carol"},
+			{ExternalIdentity{Subject: "6", Email: "dave@example.com", Name: "Dave Smith"}, "dave"},
+			{ExternalIdentity{Subject: "7", Email: "é@example.com", Name: "<script>"}, ""},
+		}
+		for _, c := range cases {
+			c.ext.Provider = "gitlab"
+			c.ext.EmailVerified = true
+			user, err := LoginWithIdentity(ctx, s.tx, c.ext, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if validateUsername(user.Name) != "" || (c.name != "" && user.Name != c.name) {
+				t.Errorf("%q of %s got the name %q, want %q", c.ext.Name, c.ext.Email, user.Name, c.name)
+			}
+		}
+	})
+
+	t.Run("requires an email for new identities", func(t *testing.T) {
+		s := newSetup(t, true)
+
+		_, err := LoginWithIdentity(ctx, s.tx, ExternalIdentity{Provider: "google", Subject: "4"}, now)
+		if !errors.Is(err, ErrMissingEmail) {
+			t.Errorf("got %v, want ErrMissingEmail", err)
+		}
+	})
+}
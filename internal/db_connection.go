@@ -4,36 +4,198 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-var (
-	conn *pgxpool.Pool
-)
+// Settings of the connection pool. Zero values keep the pgxpool defaults.
+type DatabaseConfig struct {
+	URL               string
+	MaxConns          int32
+	MinConns          int32
+	MaxConnLifetime   time.Duration
+	MaxConnIdleTime   time.Duration
+	HealthCheckPeriod time.Duration
+	// Sent to postgres as `statement_timeout`, so runaway queries are
+	// cancelled by the server.
+	StatementTimeout time.Duration
+	// How many times the startup ping is retried before giving up. The wait
+	// starts at RetryBackoff and doubles after each attempt.
+	ConnectRetries int
+	RetryBackoff   time.Duration
+	// Read-only queries are spread across these, see Router.
+	ReplicaURLs []string
+	// Replicas further behind the primary than this are taken out of rotation
+	// until they catch up.
+	MaxReplicaLag time.Duration
+	// How often the replicas are checked.
+	ReplicaCheckPeriod time.Duration
+}
+
+// Reads the config from `DATABASE_URL` and the optional `DB_*` variables,
+// see env.example for the full list.
+func DatabaseConfigFromEnv() (DatabaseConfig, error) {
+	cfg := DatabaseConfig{
+		URL:                os.Getenv("DATABASE_URL"),
+		ConnectRetries:     5,
+		RetryBackoff:       500 * time.Millisecond,
+		MaxReplicaLag:      10 * time.Second,
+		ReplicaCheckPeriod: 5 * time.Second,
+	}
+	if cfg.URL == "" {
+		return cfg, fmt.Errorf("env variable `DATABASE_URL` not set")
+	}
+
+	ints := []struct {
+		name  string
+		value *int32
+	}{
+		{"DB_MAX_CONNS", &cfg.MaxConns},
+		{"DB_MIN_CONNS", &cfg.MinConns},
+	}
+	for _, v := range ints {
+		if s := os.Getenv(v.name); s != "" {
+			n, err := strconv.ParseInt(s, 10, 32)
+			if err != nil {
+				return cfg, fmt.Errorf("invalid `%s`: %v", v.name, err)
+			}
+			*v.value = int32(n)
+		}
+	}
+
+	durations := []struct {
+		name  string
+		value *time.Duration
+	}{
+		{"DB_MAX_CONN_LIFETIME", &cfg.MaxConnLifetime},
+		{"DB_MAX_CONN_IDLE_TIME", &cfg.MaxConnIdleTime},
+		{"DB_HEALTH_CHECK_PERIOD", &cfg.HealthCheckPeriod},
+		{"DB_STATEMENT_TIMEOUT", &cfg.StatementTimeout},
+		{"DB_RETRY_BACKOFF", &cfg.RetryBackoff},
+		{"DB_MAX_REPLICA_LAG", &cfg.MaxReplicaLag},
+		{"DB_REPLICA_CHECK_PERIOD", &cfg.ReplicaCheckPeriod},
+	}
+	for _, v := range durations {
+		if s := os.Getenv(v.name); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return cfg, fmt.Errorf("invalid `%s`: %v", v.name, err)
+			}
+			*v.value = d
+		}
+	}
+
+	if s := os.Getenv("DB_CONNECT_RETRIES"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid `DB_CONNECT_RETRIES`: %v", err)
+		}
+		cfg.ConnectRetries = n
+	}
+
+	for _, url := range strings.Split(os.Getenv("DATABASE_REPLICA_URLS"), ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			cfg.ReplicaURLs = append(cfg.ReplicaURLs, url)
+		}
+	}
+
+	return cfg, nil
+}
+
+// Connection pool shared by the whole application. Create it once in main and
+// pass it to whoever needs to talk to the database.
+type Database struct {
+	pool   *pgxpool.Pool
+	router *Router
+}
+
+// Creates the pool and pings the database, retrying with exponential backoff
+// so the app can start before the database is ready (e.g. on docker compose).
+// Replicas don't block the startup, they join the rotation once healthy.
+func OpenDatabase(ctx context.Context, cfg DatabaseConfig) (*Database, error) {
+	pool_cfg, err := poolConfig(cfg.URL, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := pgxpool.NewWithConfig(ctx, pool_cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create connection pool: %v", err)
+	}
 
-// Initializes the database connection pool
-func ConnectDatabase() error {
-	var err error
-	db_url := os.Getenv("DATABASE_URL")
-	if db_url == "" {
-		return fmt.Errorf("env variable `DATABASE_URL` not set")
+	backoff := cfg.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		err = pool.Ping(ctx)
+		if err == nil {
+			break
+		}
+		if attempt >= cfg.ConnectRetries {
+			pool.Close()
+			return nil, fmt.Errorf("unable to connect to database: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			pool.Close()
+			return nil, fmt.Errorf("unable to connect to database: %v", ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
 	}
 
-	conn, err = pgxpool.New(context.Background(), db_url)
+	router, err := newRouter(ctx, pool, cfg)
+	if err != nil {
+		pool.Close()
+		return nil, err
+	}
+
+	return &Database{pool: pool, router: router}, nil
+}
+
+// Pool settings shared by the primary and the replicas.
+func poolConfig(url string, cfg DatabaseConfig) (*pgxpool.Config, error) {
+	pool_cfg, err := pgxpool.ParseConfig(url)
 	if err != nil {
-		return fmt.Errorf("unable to connect to database: %v", err)
+		return nil, fmt.Errorf("invalid database url: %v", err)
+	}
+
+	if cfg.MaxConns > 0 {
+		pool_cfg.MaxConns = cfg.MaxConns
+	}
+	if cfg.MinConns > 0 {
+		pool_cfg.MinConns = cfg.MinConns
+	}
+	if cfg.MaxConnLifetime > 0 {
+		pool_cfg.MaxConnLifetime = cfg.MaxConnLifetime
 	}
+	if cfg.MaxConnIdleTime > 0 {
+		pool_cfg.MaxConnIdleTime = cfg.MaxConnIdleTime
+	}
+	if cfg.HealthCheckPeriod > 0 {
+		pool_cfg.HealthCheckPeriod = cfg.HealthCheckPeriod
+	}
+	if cfg.StatementTimeout > 0 {
+		pool_cfg.ConnConfig.RuntimeParams["statement_timeout"] = strconv.FormatInt(cfg.StatementTimeout.Milliseconds(), 10)
+	}
+
+	return pool_cfg, nil
+}
 
-	return nil
+// Get a connection from the pool. Don't forget to release it.
+func (db *Database) Acquire(ctx context.Context) (*pgxpool.Conn, error) {
+	return db.pool.Acquire(ctx)
 }
 
-// Get a connection from the pool
-func GetConnection(ctx context.Context) (*pgxpool.Conn, error) {
-	return conn.Acquire(ctx)
+// Checks if the database is reachable.
+func (db *Database) Ping(ctx context.Context) error {
+	return db.pool.Ping(ctx)
 }
 
-// Closes the pool. All connections will be closed aswell.
-func CloseConn() {
-	conn.Close()
+// Closes the pool and the replicas. All connections will be closed aswell.
+func (db *Database) Close() {
+	db.router.close()
+	db.pool.Close()
 }
@@ -0,0 +1,261 @@
+package internal
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Migrations follow the `<version>_<name>.up.sql` and `.down.sql` naming, the
+// same one used by golang-migrate, so sqlc can read them as the schema.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Arbitrary key ("migratio" in ASCII) so our lock doesn't clash with other
+// advisory locks. Any instance running migrations waits for the one holding it.
+const migrationLockKey int64 = 0x6d6967726174696f
+
+type Migration struct {
+	Version int64
+	Name    string
+	up      string
+	down    string
+}
+
+type MigrationState struct {
+	Migration
+	// Zero when the migration is still pending.
+	AppliedAt time.Time
+}
+
+// Lists all embedded migrations ordered by version.
+func Migrations() ([]Migration, error) {
+	files, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list migrations: %v", err)
+	}
+
+	by_version := make(map[int64]*Migration)
+	for _, file := range files {
+		base := path.Base(file)
+		direction := ""
+		switch {
+		case strings.HasSuffix(base, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(base, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("migration `%s` must end with .up.sql or .down.sql", base)
+		}
+
+		version_str, name, ok := strings.Cut(strings.TrimSuffix(base, "."+direction+".sql"), "_")
+		if !ok {
+			return nil, fmt.Errorf("migration `%s` must be named <version>_<name>", base)
+		}
+		version, err := strconv.ParseInt(version_str, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version on migration `%s`: %v", base, err)
+		}
+
+		data, err := migrationFiles.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration `%s`: %v", base, err)
+		}
+
+		m, ok := by_version[version]
+		if !ok {
+			m = &Migration{Version: version, Name: name}
+			by_version[version] = m
+		} else if m.Name != name {
+			return nil, fmt.Errorf("migration version %d is used by `%s` and `%s`", version, m.Name, name)
+		}
+
+		if direction == "up" {
+			m.up = string(data)
+		} else {
+			m.down = string(data)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(by_version))
+	for _, m := range by_version {
+		if m.up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// Applies every pending migration, returning the ones that were applied.
+func (db *Database) MigrateUp(ctx context.Context) ([]Migration, error) {
+	var applied []Migration
+	err := db.withMigrationLock(ctx, func(c *pgxpool.Conn) error {
+		states, err := migrationStates(ctx, c)
+		if err != nil {
+			return err
+		}
+
+		for _, state := range states {
+			if !state.AppliedAt.IsZero() {
+				continue
+			}
+
+			err := runMigration(ctx, c, state.Migration, state.up,
+				"INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", state.Version, state.Name)
+			if err != nil {
+				return err
+			}
+			applied = append(applied, state.Migration)
+		}
+
+		return nil
+	})
+
+	return applied, err
+}
+
+// Reverts the last `steps` applied migrations, newest first.
+func (db *Database) MigrateDown(ctx context.Context, steps int) ([]Migration, error) {
+	var reverted []Migration
+	err := db.withMigrationLock(ctx, func(c *pgxpool.Conn) error {
+		states, err := migrationStates(ctx, c)
+		if err != nil {
+			return err
+		}
+
+		for i := len(states) - 1; i >= 0 && len(reverted) < steps; i-- {
+			state := states[i]
+			if state.AppliedAt.IsZero() {
+				continue
+			}
+			if state.down == "" {
+				return fmt.Errorf("migration %d_%s can't be reverted, it has no down file", state.Version, state.Name)
+			}
+
+			err := runMigration(ctx, c, state.Migration, state.down,
+				"DELETE FROM schema_migrations WHERE version = $1", state.Version)
+			if err != nil {
+				return err
+			}
+			reverted = append(reverted, state.Migration)
+		}
+
+		return nil
+	})
+
+	return reverted, err
+}
+
+// Lists every migration and when it was applied.
+func (db *Database) MigrationStatus(ctx context.Context) ([]MigrationState, error) {
+	var states []MigrationState
+	err := db.withMigrationLock(ctx, func(c *pgxpool.Conn) error {
+		var err error
+		states, err = migrationStates(ctx, c)
+		return err
+	})
+
+	return states, err
+}
+
+// Holds the advisory lock while f runs, so two instances starting at the same
+// time don't apply the same migration twice. The lock belongs to the
+// connection, so f must use the one it receives.
+func (db *Database) withMigrationLock(ctx context.Context, f func(*pgxpool.Conn) error) error {
+	c, err := db.pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get connection: %v", err)
+	}
+	defer c.Release()
+
+	_, err = c.Exec(ctx, "SELECT pg_advisory_lock($1)", migrationLockKey)
+	if err != nil {
+		return fmt.Errorf("failed to acquire migration lock: %v", err)
+	}
+	defer c.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockKey)
+
+	_, err = c.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version BIGINT PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %v", err)
+	}
+
+	return f(c)
+}
+
+func migrationStates(ctx context.Context, c *pgxpool.Conn) ([]MigrationState, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := c.Query(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %v", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int64]time.Time)
+	for rows.Next() {
+		var version int64
+		var applied_at time.Time
+		if err := rows.Scan(&version, &applied_at); err != nil {
+			return nil, fmt.Errorf("failed to read schema_migrations: %v", err)
+		}
+		applied[version] = applied_at
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %v", err)
+	}
+
+	states := make([]MigrationState, 0, len(migrations))
+	for _, m := range migrations {
+		states = append(states, MigrationState{Migration: m, AppliedAt: applied[m.Version]})
+	}
+
+	return states, nil
+}
+
+// Runs the migration script and the bookkeeping query in the same
+// transaction, so a failed migration leaves no trace.
+func runMigration(ctx context.Context, c *pgxpool.Conn, m Migration, script string, bookkeeping string, args ...any) error {
+	tx, err := c.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, script)
+	if err != nil {
+		return fmt.Errorf("failed to run migration %d_%s: %v", m.Version, m.Name, err)
+	}
+
+	_, err = tx.Exec(ctx, bookkeeping, args...)
+	if err != nil {
+		return fmt.Errorf("failed to record migration %d_%s: %v", m.Version, m.Name, err)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to commit migration %d_%s: %v", m.Version, m.Name, err)
+	}
+
+	return nil
+}
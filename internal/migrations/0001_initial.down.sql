@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS Users;
+DROP TABLE IF EXISTS Posts;
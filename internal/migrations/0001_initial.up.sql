@@ -0,0 +1,17 @@
+-- Tables from before migrations existed. They may already be there if the
+-- database was created from the old `schema.sql`.
+CREATE TABLE IF NOT EXISTS Posts (
+	id UUID PRIMARY KEY,
+	title TEXT,
+	subtitle TEXT,
+	content TEXT,
+	created_at TIMESTAMP,
+	updated_at TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS Users (
+	id UUID PRIMARY KEY,
+	name TEXT,
+	email TEXT UNIQUE,
+	password BYTEA
+);
@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS Sessions (
+	id TEXT PRIMARY KEY,
+	data BYTEA NOT NULL,
+	expires_at TIMESTAMP NOT NULL
+);
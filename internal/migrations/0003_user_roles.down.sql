@@ -0,0 +1,2 @@
+ALTER TABLE Users DROP COLUMN IF EXISTS permissions;
+ALTER TABLE Users DROP COLUMN IF EXISTS role;
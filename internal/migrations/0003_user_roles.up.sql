@@ -0,0 +1,2 @@
+ALTER TABLE Users ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'user';
+ALTER TABLE Users ADD COLUMN IF NOT EXISTS permissions TEXT[] NOT NULL DEFAULT '{}';
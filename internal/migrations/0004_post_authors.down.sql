@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS posts_author_id_idx;
+ALTER TABLE Posts DROP COLUMN IF EXISTS author_id;
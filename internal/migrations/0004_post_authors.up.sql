@@ -0,0 +1,2 @@
+ALTER TABLE Posts ADD COLUMN IF NOT EXISTS author_id UUID REFERENCES Users(id) ON DELETE SET NULL;
+CREATE INDEX IF NOT EXISTS posts_author_id_idx ON Posts (author_id);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS posts_search_idx;
+ALTER TABLE Posts DROP COLUMN IF EXISTS search;
@@ -0,0 +1,6 @@
+ALTER TABLE Posts ADD COLUMN IF NOT EXISTS search TSVECTOR GENERATED ALWAYS AS (
+	setweight(to_tsvector('english', coalesce(title, '')), 'A') ||
+	setweight(to_tsvector('english', coalesce(subtitle, '')), 'B') ||
+	setweight(to_tsvector('english', coalesce(content, '')), 'C')
+) STORED;
+CREATE INDEX IF NOT EXISTS posts_search_idx ON Posts USING GIN (search);
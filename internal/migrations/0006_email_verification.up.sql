@@ -0,0 +1,4 @@
+ALTER TABLE Users ADD COLUMN IF NOT EXISTS verified_at TIMESTAMPTZ;
+
+-- Accounts created before verification existed are trusted as they are.
+UPDATE Users SET verified_at = now() WHERE verified_at IS NULL;
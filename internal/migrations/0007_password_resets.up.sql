@@ -0,0 +1,8 @@
+-- Only the SHA-256 of each token is stored, so a leaked table can't be used to
+-- reset passwords.
+CREATE TABLE IF NOT EXISTS PasswordResets (
+	token_hash BYTEA PRIMARY KEY,
+	user_id UUID NOT NULL REFERENCES Users(id) ON DELETE CASCADE,
+	expires_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS password_resets_user_id_idx ON PasswordResets (user_id);
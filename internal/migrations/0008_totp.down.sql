@@ -0,0 +1,4 @@
+ALTER TABLE Users DROP COLUMN IF EXISTS recovery_codes;
+ALTER TABLE Users DROP COLUMN IF EXISTS totp_last_step;
+ALTER TABLE Users DROP COLUMN IF EXISTS totp_enabled_at;
+ALTER TABLE Users DROP COLUMN IF EXISTS totp_secret;
@@ -0,0 +1,8 @@
+-- The secret is encrypted by the app. It's set when enrollment starts, and
+-- totp_enabled_at only once the user confirms it with a code.
+ALTER TABLE Users ADD COLUMN IF NOT EXISTS totp_secret BYTEA;
+ALTER TABLE Users ADD COLUMN IF NOT EXISTS totp_enabled_at TIMESTAMPTZ;
+-- Last time step accepted, so a code can't be used twice.
+ALTER TABLE Users ADD COLUMN IF NOT EXISTS totp_last_step BIGINT NOT NULL DEFAULT 0;
+-- SHA-256 of the recovery codes that weren't used yet.
+ALTER TABLE Users ADD COLUMN IF NOT EXISTS recovery_codes BYTEA[] NOT NULL DEFAULT '{}';
@@ -0,0 +1,22 @@
+-- Failed logins per key (an IP or an account), used by the login throttle when
+-- running on several instances. Keys are hashed, so emails aren't kept here.
+CREATE TABLE IF NOT EXISTS LoginThrottles (
+	id TEXT PRIMARY KEY,
+	failures INTEGER NOT NULL,
+	last_failure TIMESTAMPTZ NOT NULL,
+	expires_at TIMESTAMPTZ NOT NULL
+);
+
+-- Every login attempt, kept for auditing. The email is the one typed, which
+-- may not belong to any user.
+CREATE TABLE IF NOT EXISTS LoginAttempts (
+	id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+	user_id UUID REFERENCES Users(id) ON DELETE SET NULL,
+	email TEXT NOT NULL,
+	ip TEXT NOT NULL,
+	succeeded BOOLEAN NOT NULL,
+	reason TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS login_attempts_user_id_idx ON LoginAttempts (user_id, created_at);
+CREATE INDEX IF NOT EXISTS login_attempts_ip_idx ON LoginAttempts (ip, created_at);
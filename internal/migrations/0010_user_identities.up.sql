@@ -0,0 +1,11 @@
+-- Accounts of external identity providers linked to the users. The subject is
+-- only unique within its provider.
+CREATE TABLE IF NOT EXISTS UserIdentities (
+	provider TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	user_id UUID NOT NULL REFERENCES Users(id) ON DELETE CASCADE,
+	email TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (provider, subject)
+);
+CREATE INDEX IF NOT EXISTS user_identities_user_id_idx ON UserIdentities (user_id);
@@ -0,0 +1,185 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// What the caller is about to do with the database.
+type Intent int
+
+const (
+	// Reads may be served by a replica, so they can be slightly stale.
+	IntentRead Intent = iota
+	// Writes, and reads that must see them, always go to the primary.
+	IntentWrite
+)
+
+type intentKey struct{}
+
+// Sets the intent of every query made with ctx. IntentWrite pins them to the
+// primary, use it on requests that write or must see a write made just before.
+func WithIntent(ctx context.Context, intent Intent) context.Context {
+	return context.WithValue(ctx, intentKey{}, intent)
+}
+
+func intentFrom(ctx context.Context) Intent {
+	intent, _ := ctx.Value(intentKey{}).(Intent)
+	return intent
+}
+
+// Seconds the replica is behind the primary. Replay timestamps don't move
+// while the primary is idle, so a replica that replayed everything it
+// received isn't behind at all.
+const replicaLagQuery = `SELECT CASE
+	WHEN NOT pg_is_in_recovery() OR pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+	ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+END::float8`
+
+type replica struct {
+	host    string
+	pool    *pgxpool.Pool
+	healthy atomic.Bool
+}
+
+// Sends the queries to the primary or to one of the healthy replicas. It
+// implements the sqlc DBTX interface, so queries created from it are routed
+// on each call: SELECTs go to the replicas in turns, unless the context was
+// marked with IntentWrite, and everything else goes to the primary. When no
+// replica is healthy, the primary takes all the queries.
+type Router struct {
+	primary  *pgxpool.Pool
+	replicas []*replica
+	next     atomic.Uint64
+	max_lag  time.Duration
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newRouter(ctx context.Context, primary *pgxpool.Pool, cfg DatabaseConfig) (*Router, error) {
+	r := &Router{primary: primary, max_lag: cfg.MaxReplicaLag, stop: make(chan struct{})}
+	for _, url := range cfg.ReplicaURLs {
+		pool_cfg, err := poolConfig(url, cfg)
+		if err != nil {
+			r.close()
+			return nil, fmt.Errorf("invalid replica: %v", err)
+		}
+
+		pool, err := pgxpool.NewWithConfig(ctx, pool_cfg)
+		if err != nil {
+			r.close()
+			return nil, fmt.Errorf("unable to create replica pool: %v", err)
+		}
+		r.replicas = append(r.replicas, &replica{host: pool_cfg.ConnConfig.Host, pool: pool})
+	}
+	if len(r.replicas) == 0 {
+		return r, nil
+	}
+
+	r.checkReplicas(ctx)
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ticker := time.NewTicker(cfg.ReplicaCheckPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+				r.checkReplicas(context.Background())
+			}
+		}
+	}()
+
+	return r, nil
+}
+
+// Takes replicas that are down or lagging out of the rotation, and puts back
+// the ones that recovered.
+func (r *Router) checkReplicas(ctx context.Context) {
+	for _, rep := range r.replicas {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		var lag float64
+		err := rep.pool.QueryRow(ctx, replicaLagQuery).Scan(&lag)
+		cancel()
+
+		healthy := err == nil && time.Duration(lag*float64(time.Second)) <= r.max_lag
+		if was := rep.healthy.Swap(healthy); was != healthy {
+			if healthy {
+				log.Printf("replica %s is back in rotation", rep.host)
+			} else if err != nil {
+				log.Printf("replica %s taken out of rotation: %v", rep.host, err)
+			} else {
+				log.Printf("replica %s taken out of rotation: %.1fs behind", rep.host, lag)
+			}
+		}
+	}
+}
+
+// Picks where a query made with ctx should run.
+func (r *Router) pick(ctx context.Context, sql string) *pgxpool.Pool {
+	if len(r.replicas) == 0 || intentFrom(ctx) == IntentWrite || !isReadOnly(sql) {
+		return r.primary
+	}
+
+	start := r.next.Add(1)
+	for i := range r.replicas {
+		rep := r.replicas[(start+uint64(i))%uint64(len(r.replicas))]
+		if rep.healthy.Load() {
+			return rep.pool
+		}
+	}
+
+	return r.primary
+}
+
+func (r *Router) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	return r.primary.Exec(ctx, sql, args...)
+}
+
+func (r *Router) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	return r.pick(ctx, sql).Query(ctx, sql, args...)
+}
+
+func (r *Router) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	return r.pick(ctx, sql).QueryRow(ctx, sql, args...)
+}
+
+func (r *Router) close() {
+	close(r.stop)
+	r.wg.Wait()
+	for _, rep := range r.replicas {
+		rep.pool.Close()
+	}
+}
+
+// Any of the row locking clauses: FOR UPDATE, FOR NO KEY UPDATE, FOR SHARE and
+// FOR KEY SHARE.
+var lockingClause = regexp.MustCompile(`\bFOR\s+(NO\s+KEY\s+UPDATE|UPDATE|KEY\s+SHARE|SHARE)\b`)
+
+// sqlc puts a `-- name:` comment before each query, which is skipped to find
+// the statement. Locking reads must run on the primary too.
+func isReadOnly(sql string) bool {
+	for {
+		sql = strings.TrimSpace(sql)
+		if !strings.HasPrefix(sql, "--") {
+			break
+		}
+		_, sql, _ = strings.Cut(sql, "\n")
+	}
+
+	upper := strings.ToUpper(sql)
+	return strings.HasPrefix(upper, "SELECT") && !lockingClause.MatchString(upper)
+}
@@ -0,0 +1,27 @@
+package internal
+
+import "testing"
+
+func TestIsReadOnly(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want bool
+	}{
+		{"SELECT * FROM Users WHERE id = $1", true},
+		{"-- name: GetUser :one\nSELECT * FROM Users WHERE id = $1", true},
+		{"select * from Users", true},
+		{"INSERT INTO Users (id) VALUES ($1)", false},
+		{"SELECT * FROM Users WHERE id = $1 FOR UPDATE", false},
+		{"SELECT * FROM Users WHERE id = $1 FOR NO KEY UPDATE", false},
+		{"SELECT * FROM Users WHERE id = $1 FOR SHARE", false},
+		{"SELECT * FROM Users WHERE id = $1 FOR KEY SHARE", false},
+		{"SELECT * FROM Users WHERE id = $1\nFOR UPDATE SKIP LOCKED", false},
+		{"-- name: Lock :one\nSELECT 1 FROM Users\n  for  no key  update", false},
+	}
+
+	for _, tt := range tests {
+		if got := isReadOnly(tt.sql); got != tt.want {
+			t.Errorf("isReadOnly(%q) = %v, want %v", tt.sql, got, tt.want)
+		}
+	}
+}
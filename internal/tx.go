@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/robertoesteves13/go-template/internal/database"
+)
+
+// SQLSTATE sent by postgres when a serializable transaction conflicts with
+// another one. The whole transaction can be retried from scratch.
+const serializationFailure = "40001"
+
+type TxOption func(*txConfig)
+
+type txConfig struct {
+	isolation  pgx.TxIsoLevel
+	maxRetries int
+}
+
+// Isolation level of the transaction, defaults to the one of the server
+// (usually read committed).
+func WithIsolationLevel(level pgx.TxIsoLevel) TxOption {
+	return func(c *txConfig) {
+		c.isolation = level
+	}
+}
+
+// How many times the transaction is retried after a serialization failure.
+// Defaults to 3.
+func WithMaxRetries(retries int) TxOption {
+	return func(c *txConfig) {
+		c.maxRetries = retries
+	}
+}
+
+// Gives queries that run outside of a transaction, each one on whatever
+// connection is free. Reads may go to a replica, see Router. Use WithTx when
+// they must happen together.
+func (db *Database) Queries() *database.Queries {
+	return database.New(db.router)
+}
+
+// Runs f inside a transaction on the primary, committing if it returns nil and
+// rolling back otherwise. On a serialization failure f is called again, so it
+// must not have side effects outside the database. The failure is found with
+// errors.As, so f must return the errors of the queries as they are or
+// wrapped with %w, like the repositories do.
+func (db *Database) WithTx(ctx context.Context, f func(q *database.Queries) error, opts ...TxOption) error {
+	cfg := txConfig{maxRetries: 3}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := db.runTx(ctx, cfg, f)
+		if err == nil {
+			return nil
+		}
+
+		var pg_err *pgconn.PgError
+		if !errors.As(err, &pg_err) || pg_err.Code != serializationFailure || attempt >= cfg.maxRetries {
+			return err
+		}
+	}
+}
+
+func (db *Database) runTx(ctx context.Context, cfg txConfig, f func(q *database.Queries) error) error {
+	tx, err := db.pool.BeginTx(ctx, pgx.TxOptions{IsoLevel: cfg.isolation})
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	err = f(database.New(tx))
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,33 @@
+package go_template
+
+import (
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// Why a login failed, saved with the attempt.
+type LoginFailure string
+
+const (
+	LoginUnknownEmail  LoginFailure = "unknown_email"
+	LoginWrongPassword LoginFailure = "wrong_password"
+	LoginThrottled     LoginFailure = "throttled"
+	// The password was right, the login goes on with the second factor,
+	// which is recorded as another attempt.
+	LoginSecondFactorPending LoginFailure = "second_factor_pending"
+	LoginWrongCode           LoginFailure = "wrong_code"
+)
+
+// A try to login, either with a password or with a second factor code, kept
+// for auditing. It only succeeds when the user ends up logged in.
+type LoginAttempt struct {
+	// Zero when the email doesn't belong to any user.
+	User      ulid.ULID
+	Email     string
+	IP        string
+	Succeeded bool
+	// Empty when it succeeded.
+	Reason LoginFailure
+	At     time.Time
+}
@@ -0,0 +1,138 @@
+package go_template
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/oklog/ulid/v2"
+	"github.com/robertoesteves13/go-template/internal/database"
+)
+
+// Returned when a pagination cursor was tampered or is from another version.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+const (
+	cursorOlder byte = 'o'
+	cursorNewer byte = 'n'
+)
+
+// One page of the feed, newest posts first. The cursors are opaque tokens to
+// be sent back as the `cursor` query parameter, and are empty when there's no
+// page in that direction.
+type PostsPage struct {
+	Posts      []Post
+	NextCursor string
+	PrevCursor string
+}
+
+// The token is the direction followed by the id of the post where the page
+// starts, so users can't tell (or care) how the list is paginated.
+func encodeCursor(direction byte, id ulid.ULID) string {
+	return base64.RawURLEncoding.EncodeToString(append([]byte{direction}, id[:]...))
+}
+
+func decodeCursor(cursor string) (byte, ulid.ULID, error) {
+	var id ulid.ULID
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(b) != len(id)+1 {
+		return 0, id, ErrInvalidCursor
+	}
+
+	direction := b[0]
+	if direction != cursorOlder && direction != cursorNewer {
+		return 0, id, ErrInvalidCursor
+	}
+	copy(id[:], b[1:])
+
+	return direction, id, nil
+}
+
+// Lists a page of posts using keyset pagination, so every page costs the
+// same no matter how deep it is. An empty cursor returns the first page.
+func ListPosts(ctx context.Context, db database.Querier, cursor string, page_size int) (*PostsPage, error) {
+	// One more than needed, so we know if there's another page after it.
+	limit := int32(page_size + 1)
+
+	var rows []database.ListPostsRow
+	var direction byte
+	var err error
+	if cursor == "" {
+		rows, err = db.ListPosts(ctx, limit)
+	} else {
+		var id ulid.ULID
+		direction, id, err = decodeCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+
+		key := pgtype.UUID{Bytes: id, Valid: true}
+		if direction == cursorOlder {
+			var older []database.ListPostsOlderRow
+			older, err = db.ListPostsOlder(ctx, database.ListPostsOlderParams{Cursor: key, PageSize: limit})
+			for i := range older {
+				rows = append(rows, database.ListPostsRow(older[i]))
+			}
+		} else {
+			var newer []database.ListPostsNewerRow
+			newer, err = db.ListPostsNewer(ctx, database.ListPostsNewerParams{Cursor: key, PageSize: limit})
+			for i := range newer {
+				rows = append(rows, database.ListPostsRow(newer[i]))
+			}
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list posts: %w", err)
+	}
+
+	posts := make([]Post, 0, len(rows))
+	for i := range rows {
+		posts = append(posts, *PostFromDB(rows[i]))
+	}
+
+	return newPostsPage(posts, direction, page_size), nil
+}
+
+// Builds the page from the posts found after the cursor, which should have
+// one more than page_size when there's another page after it. Posts newer
+// than the cursor must be in ascending order, like the query returns them.
+func newPostsPage(posts []Post, direction byte, page_size int) *PostsPage {
+	has_more := len(posts) > page_size
+	if has_more {
+		posts = posts[:page_size]
+	}
+
+	// Newer posts come in ascending order, so the page must be flipped back.
+	if direction == cursorNewer {
+		slices.Reverse(posts)
+	}
+
+	page := &PostsPage{Posts: posts}
+	if len(page.Posts) == 0 {
+		return page
+	}
+
+	first := page.Posts[0].Id()
+	last := page.Posts[len(page.Posts)-1].Id()
+	switch direction {
+	case cursorOlder:
+		page.PrevCursor = encodeCursor(cursorNewer, first)
+		if has_more {
+			page.NextCursor = encodeCursor(cursorOlder, last)
+		}
+	case cursorNewer:
+		page.NextCursor = encodeCursor(cursorOlder, last)
+		if has_more {
+			page.PrevCursor = encodeCursor(cursorNewer, first)
+		}
+	default:
+		if has_more {
+			page.NextCursor = encodeCursor(cursorOlder, last)
+		}
+	}
+
+	return page
+}
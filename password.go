@@ -0,0 +1,180 @@
+package go_template
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrUnknownHash = errors.New("unknown password hash format")
+
+const bcryptMaxPasswordBytes = 72
+
+// Hashes passwords in the PHC string format, which keeps the algorithm and its
+// parameters next to the hash. Checking a password doesn't depend on the
+// hasher, so the algorithm can change while old hashes keep working, and are
+// replaced the next time their users login.
+type PasswordHasher interface {
+	Hash(password string) ([]byte, error)
+	// Whether the hash was made with another algorithm or parameters.
+	NeedsRehash(hash []byte) bool
+	// Longest password in bytes the algorithm reads, 0 when there's no
+	// limit. Passwords are checked against it before anything is saved.
+	MaxPasswordBytes() int
+}
+
+// Bcrypt with the given cost. It only reads the first 72 bytes of a password,
+// so longer ones are refused instead of silently truncated.
+type BcryptHasher struct {
+	Cost int
+}
+
+func NewBcryptHasher(cost int) (*BcryptHasher, error) {
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return nil, fmt.Errorf("bcrypt cost must be between %d and %d, got %d", bcrypt.MinCost, bcrypt.MaxCost, cost)
+	}
+
+	return &BcryptHasher{Cost: cost}, nil
+}
+
+func (h *BcryptHasher) Hash(password string) ([]byte, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	if errors.Is(err, bcrypt.ErrPasswordTooLong) {
+		return nil, ValidationErrors{"password": fmt.Sprintf("Password must have at most %d bytes", bcryptMaxPasswordBytes)}
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to hash password: %v", err)
+	}
+
+	return hashed, nil
+}
+
+func (h *BcryptHasher) NeedsRehash(hash []byte) bool {
+	cost, err := bcrypt.Cost(hash)
+	return err != nil || cost != h.Cost
+}
+
+func (h *BcryptHasher) MaxPasswordBytes() int {
+	return bcryptMaxPasswordBytes
+}
+
+// Argon2id, memory is in KiB. The defaults of NewArgon2idHasher follow the
+// OWASP recommendation.
+type Argon2idHasher struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+}
+
+const (
+	argon2SaltSize = 16
+	argon2KeySize  = 32
+)
+
+func NewArgon2idHasher(memory uint32, iterations uint32, parallelism uint8) (*Argon2idHasher, error) {
+	if memory < 8*uint32(parallelism) || iterations < 1 || parallelism < 1 {
+		return nil, fmt.Errorf("invalid argon2id parameters m=%d,t=%d,p=%d", memory, iterations, parallelism)
+	}
+
+	return &Argon2idHasher{Memory: memory, Iterations: iterations, Parallelism: parallelism}, nil
+}
+
+func DefaultArgon2idHasher() *Argon2idHasher {
+	return &Argon2idHasher{Memory: 19 * 1024, Iterations: 2, Parallelism: 1}
+}
+
+func (h *Argon2idHasher) Hash(password string) ([]byte, error) {
+	salt := make([]byte, argon2SaltSize)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %v", err)
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.Iterations, h.Memory, h.Parallelism, argon2KeySize)
+	return []byte(fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.Memory, h.Iterations, h.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	)), nil
+}
+
+func (h *Argon2idHasher) NeedsRehash(hash []byte) bool {
+	params, _, key, err := parseArgon2id(hash)
+	return err != nil || params != *h || len(key) != argon2KeySize
+}
+
+func (h *Argon2idHasher) MaxPasswordBytes() int {
+	return 0
+}
+
+// Checks the password against a hash made by any of the hashers. Users created
+// through an identity provider have no hash, and no password works for them.
+func verifyPassword(hash []byte, password string) (bool, error) {
+	switch {
+	case len(hash) == 0:
+		return false, nil
+
+	case bytes.HasPrefix(hash, []byte("$argon2id$")):
+		params, salt, key, err := parseArgon2id(hash)
+		if err != nil {
+			return false, err
+		}
+
+		other := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+		return subtle.ConstantTimeCompare(key, other) == 1, nil
+
+	case bytes.HasPrefix(hash, []byte("$2")):
+		err := bcrypt.CompareHashAndPassword(hash, []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		} else if err != nil {
+			return false, fmt.Errorf("failed to compare password: %v", err)
+		}
+
+		return true, nil
+	}
+
+	return false, ErrUnknownHash
+}
+
+// Reads `$argon2id$v=19$m=<memory>,t=<iterations>,p=<parallelism>$<salt>$<key>`.
+func parseArgon2id(hash []byte) (Argon2idHasher, []byte, []byte, error) {
+	var params Argon2idHasher
+
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, ErrUnknownHash
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2id version: %s", parts[2])
+	}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism)
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2id parameters: %v", err)
+	}
+	// argon2 panics on them.
+	_, err = NewArgon2idHasher(params.Memory, params.Iterations, params.Parallelism)
+	if err != nil {
+		return params, nil, nil, err
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2id salt: %v", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, fmt.Errorf("invalid argon2id key")
+	}
+
+	return params, salt, key, nil
+}
@@ -0,0 +1,92 @@
+package go_template
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const PasswordResetTTL = time.Hour
+
+// Creates a reset token for the user with the given email, returning the user
+// and the token to be sent to them. Only the newest token of an user works,
+// asking for another one invalidates the previous. Returns ErrNotFound when no
+// user has that email, which must not be shown to the visitor.
+func RequestPasswordReset(ctx context.Context, users UserRepository, resets PasswordResetRepository, email string, now time.Time) (*User, string, error) {
+	user, err := users.GetByEmail(ctx, email)
+	if err != nil {
+		return nil, "", err
+	}
+
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to generate token: %v", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	err = resets.DeleteForUser(ctx, user.Id)
+	if err != nil {
+		return nil, "", err
+	}
+	err = resets.Create(ctx, user.Id, hashResetToken(token), now.Add(PasswordResetTTL))
+	if err != nil {
+		return nil, "", err
+	}
+
+	return user, token, nil
+}
+
+// Uses the token to change the password of its user, returning the user.
+// Returns ErrInvalidToken when the token doesn't exist, expired or was already
+// used, and ValidationErrors when the new password isn't acceptable. The token
+// is consumed in the same transaction that saves the password, so it can
+// still be used after any failure.
+func ResetPassword(ctx context.Context, tx Transactor, hasher PasswordHasher, token string, password string, now time.Time) (*User, error) {
+	// The user is only known after consuming the token, so the checks that
+	// need their name and email are skipped.
+	if msg := validatePassword(hasher, password, "", ""); msg != "" {
+		return nil, ValidationErrors{"password": msg}
+	}
+
+	// Hashing is slow on purpose, it's done before the transaction so it
+	// doesn't stay open that long.
+	hashed, err := hasher.Hash(password)
+	if err != nil {
+		return nil, err
+	}
+
+	var user *User
+	err = tx.WithTx(ctx, func(repos TxRepositories) error {
+		id, err := repos.Resets.Consume(ctx, hashResetToken(token), now)
+		if err != nil {
+			return err
+		}
+
+		user, err = repos.Users.Get(ctx, id)
+		if errors.Is(err, ErrNotFound) {
+			return ErrInvalidToken
+		} else if err != nil {
+			return err
+		}
+
+		user.password = hashed
+		return repos.Users.UpdatePassword(ctx, user)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// The token has enough entropy, so a plain hash is enough to keep the stored
+// value useless to whoever reads the table.
+func hashResetToken(token string) []byte {
+	hash := sha256.Sum256([]byte(token))
+	return hash[:]
+}
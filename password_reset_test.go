@@ -0,0 +1,63 @@
+package go_template
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestResetPasswordKeepsTokenOnInvalidPassword(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	hasher, err := NewBcryptHasher(bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users := NewMemoryUserRepository()
+	resets := NewMemoryPasswordResetRepository()
+	tx := NewMemoryTransactor(users, resets, NewMemoryIdentityRepository())
+
+	user, err := NewUser("alice", "alice@example.com", "correct horse battery", hasher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = users.Insert(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, token, err := RequestPasswordReset(ctx, users, resets, user.Email, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fine for validatePassword's character limit, too long for bcrypt.
+	long := strings.Repeat("é", 40)
+	_, err = ResetPassword(ctx, tx, hasher, token, long, now)
+	var errs ValidationErrors
+	if !errors.As(err, &errs) || errs["password"] == "" {
+		t.Fatalf("ResetPassword with %d bytes = %v, want a password ValidationErrors", len(long), err)
+	}
+
+	_, err = ResetPassword(ctx, tx, hasher, token, "a brand new secret", now)
+	if err != nil {
+		t.Fatalf("token unusable after a refused password: %v", err)
+	}
+	saved, err := users.Get(ctx, user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err := saved.ValidatePassword(ctx, users, hasher, "a brand new secret")
+	if err != nil || !ok {
+		t.Fatalf("new password not saved: ok=%v err=%v", ok, err)
+	}
+
+	_, err = ResetPassword(ctx, tx, hasher, token, "yet another secret", now)
+	if !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("second use of the token = %v, want ErrInvalidToken", err)
+	}
+}
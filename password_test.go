@@ -0,0 +1,151 @@
+package go_template
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestArgon2idHasher(t *testing.T) {
+	hasher, err := NewArgon2idHasher(64, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := hasher.Hash("correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(hash), "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Errorf("got hash %s, want the PHC format", hash)
+	}
+	other, err := hasher.Hash("correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(other) == string(hash) {
+		t.Error("two hashes of the same password are equal, the salt isn't random")
+	}
+
+	for password, want := range map[string]bool{"correct horse battery": true, "correct horse batterY": false, "": false} {
+		ok, err := verifyPassword(hash, password)
+		if err != nil || ok != want {
+			t.Errorf("verifying `%s` got %v, %v, want %v", password, ok, err, want)
+		}
+	}
+
+	if hasher.NeedsRehash(hash) {
+		t.Error("hash of the same parameters needs a rehash")
+	}
+	for _, changed := range []*Argon2idHasher{
+		{Memory: 128, Iterations: 1, Parallelism: 1},
+		{Memory: 64, Iterations: 2, Parallelism: 1},
+		{Memory: 64, Iterations: 1, Parallelism: 2},
+	} {
+		if !changed.NeedsRehash(hash) {
+			t.Errorf("hash of m=64,t=1,p=1 doesn't need a rehash for %+v", *changed)
+		}
+	}
+}
+
+func TestBcryptHasher(t *testing.T) {
+	hasher, err := NewBcryptHasher(bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := hasher.Hash("correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err := verifyPassword(hash, "correct horse battery")
+	if err != nil || !ok {
+		t.Errorf("verifying the password got %v, %v", ok, err)
+	}
+	ok, err = verifyPassword(hash, "wrong password")
+	if err != nil || ok {
+		t.Errorf("verifying a wrong password got %v, %v", ok, err)
+	}
+
+	if hasher.NeedsRehash(hash) {
+		t.Error("hash of the same cost needs a rehash")
+	}
+	if !(&BcryptHasher{Cost: bcrypt.MinCost + 1}).NeedsRehash(hash) {
+		t.Error("hash of another cost doesn't need a rehash")
+	}
+
+	_, err = hasher.Hash(strings.Repeat("a", bcryptMaxPasswordBytes+1))
+	var validation ValidationErrors
+	if !errors.As(err, &validation) || validation["password"] == "" {
+		t.Errorf("hashing a too long password got %v, want ValidationErrors", err)
+	}
+}
+
+func TestNeedsRehashAcrossAlgorithms(t *testing.T) {
+	argon, err := NewArgon2idHasher(64, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcrypt_hasher, err := NewBcryptHasher(bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	argon_hash, err := argon.Hash("correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcrypt_hash, err := bcrypt_hasher.Hash("correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !argon.NeedsRehash(bcrypt_hash) || !bcrypt_hasher.NeedsRehash(argon_hash) {
+		t.Error("hash of another algorithm doesn't need a rehash")
+	}
+	// Old hashes keep working while they wait for the rehash.
+	for _, hash := range [][]byte{argon_hash, bcrypt_hash} {
+		ok, err := verifyPassword(hash, "correct horse battery")
+		if err != nil || !ok {
+			t.Errorf("verifying %s got %v, %v", hash, ok, err)
+		}
+	}
+}
+
+func TestMalformedHashes(t *testing.T) {
+	argon, err := NewArgon2idHasher(64, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	malformed := []string{
+		"correct horse battery",
+		"$argon2i$v=19$m=64,t=1,p=1$c2FsdHNhbHRzYWx0$a2V5",
+		"$argon2id$v=18$m=64,t=1,p=1$c2FsdHNhbHRzYWx0$a2V5",
+		"$argon2id$v=19$m=64,t=1$c2FsdHNhbHRzYWx0$a2V5",
+		"$argon2id$v=19$m=64,t=1,p=0$c2FsdHNhbHRzYWx0$a2V5",
+		"$argon2id$v=19$m=0,t=1,p=1$c2FsdHNhbHRzYWx0$a2V5",
+		"$argon2id$v=19$m=64,t=0,p=1$c2FsdHNhbHRzYWx0$a2V5",
+		"$argon2id$v=19$m=64,t=1,p=1$not base64!$a2V5",
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHRzYWx0$",
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHRzYWx0",
+		"$2a$10$short",
+	}
+	for _, hash := range malformed {
+		ok, err := verifyPassword([]byte(hash), "correct horse battery")
+		if ok || err == nil {
+			t.Errorf("verifying against `%s` got %v, %v, want an error", hash, ok, err)
+		}
+		if !argon.NeedsRehash([]byte(hash)) {
+			t.Errorf("`%s` doesn't need a rehash", hash)
+		}
+	}
+
+	// Users of identity providers have no password at all.
+	ok, err := verifyPassword(nil, "")
+	if ok || err != nil {
+		t.Errorf("verifying against no hash got %v, %v, want false", ok, err)
+	}
+}
@@ -2,11 +2,14 @@ package go_template
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
+	"unicode/utf8"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgtype"
-	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/oklog/ulid/v2"
 	"github.com/robertoesteves13/go-template/internal/database"
 )
@@ -18,19 +21,74 @@ type Post struct {
 	content    string
 	created_at time.Time
 	updated_at time.Time
+	author     *Author
 }
 
-func NewPost() *Post {
+// Public information about who wrote a post.
+type Author struct {
+	Id   ulid.ULID
+	Name string
+}
+
+func (a *Author) URL() string {
+	return fmt.Sprintf("/user/%s", a.Id)
+}
+
+func NewPost(author *User, title, subtitle, content string) *Post {
+	now := time.Now()
 	return &Post{
-		ulid.Make(),
-		"New Post",
-		"This is a new post, what's inside it?",
-		"Surprise! it's just a bunch of useless text :P.",
-		time.Now(),
-		time.Now(),
+		id:         ulid.Make(),
+		title:      strings.TrimSpace(title),
+		subtitle:   strings.TrimSpace(subtitle),
+		content:    content,
+		created_at: now,
+		updated_at: now,
+		author:     &Author{Id: author.Id, Name: author.Name},
 	}
 }
 
+const (
+	maxTitleLength    = 200
+	maxSubtitleLength = 300
+	maxContentLength  = 100_000
+)
+
+// Checks if the post can be saved, returning ValidationErrors with the
+// problem of each field.
+func (p *Post) Validate() error {
+	errs := ValidationErrors{}
+	if p.title == "" {
+		errs["title"] = "Title is required"
+	} else if utf8.RuneCountInString(p.title) > maxTitleLength {
+		errs["title"] = fmt.Sprintf("Title must have at most %d characters", maxTitleLength)
+	}
+
+	if utf8.RuneCountInString(p.subtitle) > maxSubtitleLength {
+		errs["subtitle"] = fmt.Sprintf("Subtitle must have at most %d characters", maxSubtitleLength)
+	}
+
+	if strings.TrimSpace(p.content) == "" {
+		errs["content"] = "Content is required"
+	} else if utf8.RuneCountInString(p.content) > maxContentLength {
+		errs["content"] = fmt.Sprintf("Content must have at most %d characters", maxContentLength)
+	}
+
+	return errs.OrNil()
+}
+
+// Only the author and users with the right permission can change a post.
+func (p *Post) CanEdit(u *User) bool {
+	return u != nil && (p.IsAuthor(u) || u.HasPermission(PermissionPostEdit))
+}
+
+func (p *Post) CanDelete(u *User) bool {
+	return u != nil && (p.IsAuthor(u) || u.HasPermission(PermissionPostDelete))
+}
+
+func (p *Post) IsAuthor(u *User) bool {
+	return u != nil && p.author != nil && p.author.Id == u.Id
+}
+
 func (p *Post) Id() ulid.ULID {
 	return p.id
 }
@@ -47,6 +105,11 @@ func (p *Post) Content() string {
 	return p.content
 }
 
+// Who wrote the post. It's nil when the author deleted their account.
+func (p *Post) Author() *Author {
+	return p.author
+}
+
 func (p *Post) CreatedAt() time.Time {
 	return p.created_at
 }
@@ -56,12 +119,12 @@ func (p *Post) UpdatedAt() time.Time {
 }
 
 func (p *Post) SetTitle(title string) {
-	p.title = title
+	p.title = strings.TrimSpace(title)
 	p.updated_at = time.Now()
 }
 
 func (p *Post) SetSubtitle(subtitle string) {
-	p.subtitle = subtitle
+	p.subtitle = strings.TrimSpace(subtitle)
 	p.updated_at = time.Now()
 }
 
@@ -74,10 +137,8 @@ func (p *Post) URL() string {
 	return fmt.Sprintf("/post/%s", p.Id())
 }
 
-func (p *Post) UpdateDB(ctx context.Context, conn *pgxpool.Conn) error {
-	db := database.New(conn)
-	var updated_at pgtype.Timestamp
-	updated_at.Time = p.updated_at
+func (p *Post) UpdateDB(ctx context.Context, db database.Querier) error {
+	updated_at := pgtype.Timestamp{Time: p.updated_at, Valid: true}
 
 	return db.UpdatePost(ctx, database.UpdatePostParams{
 		Title:     pgtype.Text{String: p.title, Valid: true},
@@ -88,14 +149,9 @@ func (p *Post) UpdateDB(ctx context.Context, conn *pgxpool.Conn) error {
 	})
 }
 
-func (p *Post) InsertDB(ctx context.Context, conn *pgxpool.Conn) error {
-	db := database.New(conn)
-	var updated_at pgtype.Timestamp
-	var created_at pgtype.Timestamp
-
-	updated_at.Time = p.updated_at
-	created_at.Time = p.created_at
-
+func (p *Post) InsertDB(ctx context.Context, db database.Querier) error {
+	updated_at := pgtype.Timestamp{Time: p.updated_at, Valid: true}
+	created_at := pgtype.Timestamp{Time: p.created_at, Valid: true}
 
 	return db.InsertPost(ctx, database.InsertPostParams{
 		Title:     pgtype.Text{String: p.title, Valid: true},
@@ -104,11 +160,54 @@ func (p *Post) InsertDB(ctx context.Context, conn *pgxpool.Conn) error {
 		UpdatedAt: updated_at,
 		CreatedAt: created_at,
 		ID:        pgtype.UUID{Bytes: p.id, Valid: true},
+		AuthorID:  p.authorID(),
 	})
 }
 
-func PostFromDB(post database.Post) *Post {
-	return &Post{
+func (p *Post) DeleteDB(ctx context.Context, db database.Querier) error {
+	return db.DeletePost(ctx, pgtype.UUID{Bytes: p.id, Valid: true})
+}
+
+func (p *Post) authorID() pgtype.UUID {
+	if p.author == nil {
+		return pgtype.UUID{}
+	}
+
+	return pgtype.UUID{Bytes: p.author.Id, Valid: true}
+}
+
+// Gets a single post, returning ErrNotFound if it doesn't exist.
+func GetPost(ctx context.Context, db database.Querier, id ulid.ULID) (*Post, error) {
+	row, err := db.GetPost(ctx, pgtype.UUID{Bytes: id, Valid: true})
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get post: %w", err)
+	}
+
+	return PostFromDB(database.ListPostsRow(row)), nil
+}
+
+// Lists the posts written by an user, newest first.
+func ListPostsByAuthor(ctx context.Context, db database.Querier, author ulid.ULID) ([]Post, error) {
+	rows, err := db.ListPostsByAuthor(ctx, pgtype.UUID{Bytes: author, Valid: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list posts: %w", err)
+	}
+
+	posts := make([]Post, 0, len(rows))
+	for i := range rows {
+		posts = append(posts, *PostFromDB(database.ListPostsRow(rows[i])))
+	}
+
+	return posts, nil
+}
+
+// The author name comes from a join with the Users table, since the Posts
+// table only has the author id. All post queries return the same columns, so
+// their rows can be converted to ListPostsRow.
+func PostFromDB(post database.ListPostsRow) *Post {
+	p := &Post{
 		id:         post.ID.Bytes,
 		title:      post.Title.String,
 		subtitle:   post.Subtitle.String,
@@ -116,13 +215,10 @@ func PostFromDB(post database.Post) *Post {
 		created_at: post.CreatedAt.Time,
 		updated_at: post.UpdatedAt.Time,
 	}
-}
 
-func PostFromDBSlice(posts []database.Post) []Post {
-	ps := make([]Post, 0, len(posts))
-	for i := range posts {
-		ps = append(ps, *PostFromDB(posts[i]))
+	if post.AuthorID.Valid {
+		p.author = &Author{Id: post.AuthorID.Bytes, Name: post.AuthorName.String}
 	}
 
-	return ps
+	return p
 }
@@ -1,11 +1,42 @@
+-- Post queries list the columns explicitly, so the `search` column isn't sent
+-- back on every read.
+--
+-- Posts ids are ULIDs, so ordering by id is the same as ordering by creation
+-- time. That gives an unique and never null key for keyset pagination.
+
 -- name: ListPosts :many
-SELECT id, title, subtitle, content, created_at, updated_at FROM Posts;
+SELECT Posts.id, Posts.title, Posts.subtitle, Posts.content, Posts.created_at, Posts.updated_at, Posts.author_id, Users.name AS author_name FROM Posts
+LEFT JOIN Users ON Users.id = Posts.author_id
+ORDER BY Posts.id DESC
+LIMIT @page_size;
+
+-- name: ListPostsOlder :many
+SELECT Posts.id, Posts.title, Posts.subtitle, Posts.content, Posts.created_at, Posts.updated_at, Posts.author_id, Users.name AS author_name FROM Posts
+LEFT JOIN Users ON Users.id = Posts.author_id
+WHERE Posts.id < @cursor
+ORDER BY Posts.id DESC
+LIMIT @page_size;
+
+-- name: ListPostsNewer :many
+SELECT Posts.id, Posts.title, Posts.subtitle, Posts.content, Posts.created_at, Posts.updated_at, Posts.author_id, Users.name AS author_name FROM Posts
+LEFT JOIN Users ON Users.id = Posts.author_id
+WHERE Posts.id > @cursor
+ORDER BY Posts.id ASC
+LIMIT @page_size;
+
+-- name: ListPostsByAuthor :many
+SELECT Posts.id, Posts.title, Posts.subtitle, Posts.content, Posts.created_at, Posts.updated_at, Posts.author_id, Users.name AS author_name FROM Posts
+LEFT JOIN Users ON Users.id = Posts.author_id
+WHERE Posts.author_id = $1
+ORDER BY Posts.created_at DESC;
 
 -- name: GetPost :one
-SELECT id, title, subtitle, content, created_at, updated_at FROM Posts WHERE id = $1;
+SELECT Posts.id, Posts.title, Posts.subtitle, Posts.content, Posts.created_at, Posts.updated_at, Posts.author_id, Users.name AS author_name FROM Posts
+LEFT JOIN Users ON Users.id = Posts.author_id
+WHERE Posts.id = $1;
 
 -- name: InsertPost :exec
-INSERT INTO Posts (id, title, subtitle, content, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6);
+INSERT INTO Posts (id, title, subtitle, content, created_at, updated_at, author_id) VALUES ($1, $2, $3, $4, $5, $6, $7);
 
 -- name: UpdatePost :exec
 UPDATE Posts SET title = $1, subtitle = $2, content = $3, updated_at = $4 WHERE id = $5;
@@ -14,7 +45,112 @@ UPDATE Posts SET title = $1, subtitle = $2, content = $3, updated_at = $4 WHERE
 DELETE FROM Posts WHERE id = $1;
 
 -- name: GetUserByEmail :one
-SELECT id, name, email, password FROM Users WHERE email = $1;
+SELECT id, name, email, password, role, permissions, verified_at, totp_secret, totp_enabled_at, totp_last_step, recovery_codes FROM Users WHERE email = $1;
+
+-- name: GetUserByID :one
+SELECT id, name, email, password, role, permissions, verified_at, totp_secret, totp_enabled_at, totp_last_step, recovery_codes FROM Users WHERE id = $1;
 
 -- name: InsertUser :exec
-INSERT INTO Users (id, name, email, password) VALUES ($1, $2, $3, $4);
+INSERT INTO Users (id, name, email, password, role, permissions) VALUES ($1, $2, $3, $4, $5, $6);
+
+-- name: UpdateUserRole :exec
+UPDATE Users SET role = $1, permissions = $2 WHERE id = $3;
+
+-- Only affects unverified users, so a verification link works once.
+-- name: VerifyUser :execrows
+UPDATE Users SET verified_at = @verified_at WHERE id = @id AND verified_at IS NULL;
+
+-- name: UpdateUserPassword :exec
+UPDATE Users SET password = $1 WHERE id = $2;
+
+-- Starts the enrollment, or restarts it with a new secret.
+-- name: SetTOTPSecret :exec
+UPDATE Users SET totp_secret = @totp_secret, totp_enabled_at = NULL, totp_last_step = 0, recovery_codes = '{}' WHERE id = @id;
+
+-- name: EnableTOTP :execrows
+UPDATE Users SET totp_enabled_at = @enabled_at, recovery_codes = @recovery_codes
+WHERE id = @id AND totp_secret IS NOT NULL AND totp_enabled_at IS NULL;
+
+-- name: DisableTOTP :exec
+UPDATE Users SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = 0, recovery_codes = '{}' WHERE id = $1;
+
+-- name: UseTOTPStep :execrows
+UPDATE Users SET totp_last_step = @step WHERE id = @id AND totp_last_step < @step;
+
+-- name: UseRecoveryCode :execrows
+UPDATE Users SET recovery_codes = array_remove(recovery_codes, @code_hash::bytea)
+WHERE id = @id AND @code_hash::bytea = ANY(recovery_codes);
+
+-- name: InsertPasswordReset :exec
+INSERT INTO PasswordResets (token_hash, user_id, expires_at) VALUES ($1, $2, $3);
+
+-- Deleting the token while reading it makes it single-use, even when the link
+-- is opened twice at the same time.
+-- name: ConsumePasswordReset :one
+DELETE FROM PasswordResets WHERE token_hash = @token_hash AND expires_at > @now RETURNING user_id;
+
+-- name: DeletePasswordResets :exec
+DELETE FROM PasswordResets WHERE user_id = $1;
+
+-- name: GetSession :one
+SELECT data FROM Sessions WHERE id = @id AND expires_at > @now;
+
+-- name: SetSession :exec
+INSERT INTO Sessions (id, data, expires_at) VALUES ($1, $2, $3)
+ON CONFLICT (id) DO UPDATE SET data = EXCLUDED.data, expires_at = EXCLUDED.expires_at;
+
+-- Only rewrites sessions that still exist, so a request that read the session
+-- before it was rotated or revoked can't bring it back.
+-- name: ReplaceSession :execrows
+UPDATE Sessions SET data = @data, expires_at = @expires_at WHERE id = @id AND expires_at > @now;
+
+-- name: DeleteSession :execrows
+DELETE FROM Sessions WHERE id = $1;
+
+-- name: DeleteExpiredSessions :exec
+DELETE FROM Sessions WHERE expires_at <= @now;
+
+-- name: GetUserIdentity :one
+SELECT user_id FROM UserIdentities WHERE provider = @provider AND subject = @subject;
+
+-- name: InsertUserIdentity :exec
+INSERT INTO UserIdentities (provider, subject, user_id, email, created_at) VALUES ($1, $2, $3, $4, $5);
+
+-- name: GetLoginThrottle :one
+SELECT failures, last_failure FROM LoginThrottles WHERE id = @id AND expires_at > @now;
+
+-- Counting on the database makes concurrent failures add up instead of
+-- overwriting each other. An expired row starts over.
+-- name: AddLoginFailure :one
+INSERT INTO LoginThrottles (id, failures, last_failure, expires_at) VALUES (@id, 1, @at, @expires_at)
+ON CONFLICT (id) DO UPDATE SET
+	failures = CASE WHEN LoginThrottles.expires_at > @at THEN LoginThrottles.failures + 1 ELSE 1 END,
+	last_failure = EXCLUDED.last_failure,
+	expires_at = EXCLUDED.expires_at
+RETURNING failures, last_failure;
+
+-- name: RemoveLoginFailure :exec
+UPDATE LoginThrottles SET failures = failures - 1 WHERE id = $1 AND failures > 0;
+
+-- name: DeleteLoginThrottle :exec
+DELETE FROM LoginThrottles WHERE id = $1;
+
+-- name: DeleteExpiredLoginThrottles :exec
+DELETE FROM LoginThrottles WHERE expires_at <= @now;
+
+-- name: InsertLoginAttempt :exec
+INSERT INTO LoginAttempts (user_id, email, ip, succeeded, reason, created_at) VALUES ($1, $2, $3, $4, $5, $6);
+
+-- The headline marks the matches with ⟦ and ⟧ instead of HTML tags, since the
+-- content is user input and can't be trusted as HTML.
+--
+-- name: SearchPosts :many
+SELECT Posts.id, Posts.title, Posts.subtitle, Posts.content, Posts.created_at, Posts.updated_at, Posts.author_id, Users.name AS author_name,
+	ts_rank(Posts.search, query)::real AS rank,
+	ts_headline('english', coalesce(Posts.content, ''), query, 'StartSel=⟦, StopSel=⟧, MaxFragments=2, MaxWords=20, MinWords=5')::text AS headline
+FROM Posts
+CROSS JOIN websearch_to_tsquery('english', @query) AS query
+LEFT JOIN Users ON Users.id = Posts.author_id
+WHERE Posts.search @@ query
+ORDER BY rank DESC, Posts.id DESC
+LIMIT @page_size;
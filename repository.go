@@ -0,0 +1,82 @@
+package go_template
+
+import (
+	"context"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// Storage of the posts. Lookups return ErrNotFound when the post doesn't
+// exist. Use NewPostgresPostRepository in production and
+// NewMemoryPostRepository on tests.
+type PostRepository interface {
+	Get(ctx context.Context, id ulid.ULID) (*Post, error)
+	// Same as ListPosts, the cursor comes from a previous PostsPage.
+	List(ctx context.Context, cursor string, page_size int) (*PostsPage, error)
+	ListByAuthor(ctx context.Context, author ulid.ULID) ([]Post, error)
+	Search(ctx context.Context, query string, limit int) ([]SearchResult, error)
+	Insert(ctx context.Context, p *Post) error
+	Update(ctx context.Context, p *Post) error
+	Delete(ctx context.Context, p *Post) error
+}
+
+// Storage of the users. Lookups return ErrNotFound when the user doesn't
+// exist.
+type UserRepository interface {
+	Get(ctx context.Context, id ulid.ULID) (*User, error)
+	GetByEmail(ctx context.Context, email string) (*User, error)
+	Insert(ctx context.Context, u *User) error
+	SetRole(ctx context.Context, u *User, role Role, permissions []string) error
+	// Returns ErrAlreadyVerified if the user was verified before.
+	MarkVerified(ctx context.Context, u *User, at time.Time) error
+	// Saves the password set with User.SetPassword.
+	UpdatePassword(ctx context.Context, u *User) error
+
+	// Two-factor authentication, see TwoFactor. Setting a secret disables it
+	// until EnableTOTP is called, which returns ErrNoEnrollment when there's
+	// no secret or it's already enabled.
+	SetTOTPSecret(ctx context.Context, u *User, encrypted []byte) error
+	EnableTOTP(ctx context.Context, u *User, at time.Time, recovery_hashes [][]byte) error
+	DisableTOTP(ctx context.Context, u *User) error
+	// Both return ErrInvalidCode if the step or recovery code was already
+	// used.
+	UseTOTPStep(ctx context.Context, u *User, step int64) error
+	UseRecoveryCode(ctx context.Context, u *User, hash []byte) error
+}
+
+// Storage of the password reset tokens, which are only known by their hash.
+type PasswordResetRepository interface {
+	Create(ctx context.Context, user ulid.ULID, token_hash []byte, expires time.Time) error
+	// Deletes the token and returns its user. Returns ErrInvalidToken if the
+	// token doesn't exist or expired.
+	Consume(ctx context.Context, token_hash []byte, now time.Time) (ulid.ULID, error)
+	DeleteForUser(ctx context.Context, user ulid.ULID) error
+}
+
+// Audit log of the login attempts.
+type LoginAttemptRepository interface {
+	Record(ctx context.Context, a *LoginAttempt) error
+}
+
+// Links between users and their accounts on identity providers.
+type IdentityRepository interface {
+	// Returns the user linked to the account, or ErrNotFound.
+	Find(ctx context.Context, provider string, subject string) (ulid.ULID, error)
+	Link(ctx context.Context, i *UserIdentity) error
+}
+
+// Repositories bound to the same transaction, see Transactor.
+type TxRepositories struct {
+	Users      UserRepository
+	Resets     PasswordResetRepository
+	Identities IdentityRepository
+}
+
+// Runs f with repositories that share a transaction on the primary, so what f
+// writes through them is committed together when it returns nil and rolled
+// back otherwise. f may be called again after a serialization failure, so it
+// must not have other side effects.
+type Transactor interface {
+	WithTx(ctx context.Context, f func(repos TxRepositories) error) error
+}
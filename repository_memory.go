@@ -0,0 +1,549 @@
+package go_template
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// Keeps the posts in memory, meant for tests and trying things out without a
+// database. Search is a plain word match instead of the postgres full-text
+// search, so ranks and headlines differ.
+type MemoryPostRepository struct {
+	mu    sync.RWMutex
+	posts map[ulid.ULID]Post
+}
+
+func NewMemoryPostRepository() *MemoryPostRepository {
+	return &MemoryPostRepository{posts: make(map[ulid.ULID]Post)}
+}
+
+func (r *MemoryPostRepository) Get(ctx context.Context, id ulid.ULID) (*Post, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	post, ok := r.posts[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return clonePost(post), nil
+}
+
+func (r *MemoryPostRepository) List(ctx context.Context, cursor string, page_size int) (*PostsPage, error) {
+	var direction byte
+	var id ulid.ULID
+	if cursor != "" {
+		var err error
+		direction, id, err = decodeCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	posts := r.sorted(func(p *Post) bool {
+		switch direction {
+		case cursorOlder:
+			return p.id.Compare(id) < 0
+		case cursorNewer:
+			return p.id.Compare(id) > 0
+		default:
+			return true
+		}
+	})
+
+	// Same order the queries use: newer posts are fetched oldest first.
+	if direction == cursorNewer {
+		slices.Reverse(posts)
+	}
+	if len(posts) > page_size+1 {
+		posts = posts[:page_size+1]
+	}
+
+	return newPostsPage(posts, direction, page_size), nil
+}
+
+func (r *MemoryPostRepository) ListByAuthor(ctx context.Context, author ulid.ULID) ([]Post, error) {
+	return r.sorted(func(p *Post) bool {
+		return p.author != nil && p.author.Id == author
+	}), nil
+}
+
+func (r *MemoryPostRepository) Search(ctx context.Context, query string, limit int) ([]SearchResult, error) {
+	var include, exclude []string
+	for _, term := range strings.Fields(strings.ToLower(query)) {
+		term = strings.Trim(term, `"`)
+		if strings.HasPrefix(term, "-") {
+			exclude = append(exclude, term[1:])
+		} else if term != "" {
+			include = append(include, term)
+		}
+	}
+	if len(include) == 0 {
+		return []SearchResult{}, nil
+	}
+
+	results := make([]SearchResult, 0)
+	for _, post := range r.sorted(func(*Post) bool { return true }) {
+		text := strings.ToLower(post.title + " " + post.subtitle + " " + post.content)
+
+		rank := 0
+		for _, term := range include {
+			count := strings.Count(text, term)
+			if count == 0 {
+				rank = 0
+				break
+			}
+			rank += count
+		}
+		if rank == 0 || slices.ContainsFunc(exclude, func(term string) bool {
+			return term != "" && strings.Contains(text, term)
+		}) {
+			continue
+		}
+
+		results = append(results, SearchResult{
+			Post:     post,
+			Rank:     float32(rank),
+			Headline: memoryHeadline(post.content, include),
+		})
+	}
+
+	// The posts are already newest first, so a stable sort keeps that order
+	// between results of the same rank.
+	slices.SortStableFunc(results, func(a, b SearchResult) int {
+		switch {
+		case a.Rank > b.Rank:
+			return -1
+		case a.Rank < b.Rank:
+			return 1
+		default:
+			return 0
+		}
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+
+	return results, nil
+}
+
+func (r *MemoryPostRepository) Insert(ctx context.Context, p *Post) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.posts[p.id]; ok {
+		return fmt.Errorf("post %s already exists", p.id)
+	}
+	r.posts[p.id] = *clonePost(*p)
+
+	return nil
+}
+
+func (r *MemoryPostRepository) Update(ctx context.Context, p *Post) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.posts[p.id]; !ok {
+		return ErrNotFound
+	}
+	r.posts[p.id] = *clonePost(*p)
+
+	return nil
+}
+
+func (r *MemoryPostRepository) Delete(ctx context.Context, p *Post) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.posts, p.id)
+	return nil
+}
+
+// Copies of the posts that pass the filter, newest first.
+func (r *MemoryPostRepository) sorted(filter func(*Post) bool) []Post {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	posts := make([]Post, 0, len(r.posts))
+	for _, post := range r.posts {
+		if filter(&post) {
+			posts = append(posts, *clonePost(post))
+		}
+	}
+	slices.SortFunc(posts, func(a, b Post) int {
+		return b.id.Compare(a.id)
+	})
+
+	return posts
+}
+
+// Posts are returned as copies, so changing one doesn't change the stored
+// post until it's updated.
+func clonePost(p Post) *Post {
+	if p.author != nil {
+		author := *p.author
+		p.author = &author
+	}
+
+	return &p
+}
+
+// Up to 20 words of the content, starting a few words before the first match.
+func memoryHeadline(content string, terms []string) []TextSpan {
+	matches := func(word string) bool {
+		word = strings.ToLower(word)
+		return slices.ContainsFunc(terms, func(term string) bool {
+			return strings.Contains(word, term)
+		})
+	}
+
+	words := strings.Fields(content)
+	start := max(slices.IndexFunc(words, matches)-5, 0)
+	end := min(start+20, len(words))
+
+	var headline strings.Builder
+	for i, word := range words[start:end] {
+		if i > 0 {
+			headline.WriteString(" ")
+		}
+		if matches(word) {
+			headline.WriteString(headlineStart + word + headlineStop)
+		} else {
+			headline.WriteString(word)
+		}
+	}
+
+	return splitHeadline(headline.String())
+}
+
+// Keeps the users in memory, meant for tests and trying things out without a
+// database.
+type MemoryUserRepository struct {
+	mu             sync.RWMutex
+	users          map[ulid.ULID]User
+	by_email       map[string]ulid.ULID
+	totp_steps     map[ulid.ULID]int64
+	recovery_codes map[ulid.ULID][][]byte
+}
+
+func NewMemoryUserRepository() *MemoryUserRepository {
+	return &MemoryUserRepository{
+		users:          make(map[ulid.ULID]User),
+		by_email:       make(map[string]ulid.ULID),
+		totp_steps:     make(map[ulid.ULID]int64),
+		recovery_codes: make(map[ulid.ULID][][]byte),
+	}
+}
+
+func (r *MemoryUserRepository) Get(ctx context.Context, id ulid.ULID) (*User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	user, ok := r.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return cloneUser(user), nil
+}
+
+func (r *MemoryUserRepository) GetByEmail(ctx context.Context, email string) (*User, error) {
+	r.mu.RLock()
+	id, ok := r.by_email[email]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return r.Get(ctx, id)
+}
+
+// Fails when the email is taken, like the unique constraint on postgres.
+func (r *MemoryUserRepository) Insert(ctx context.Context, u *User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.users[u.Id]; ok {
+		return fmt.Errorf("user %s already exists", u.Id)
+	}
+	if _, ok := r.by_email[u.Email]; ok {
+		return ValidationErrors{"email": "Email is already registered"}
+	}
+	r.users[u.Id] = *cloneUser(*u)
+	r.by_email[u.Email] = u.Id
+
+	return nil
+}
+
+func (r *MemoryUserRepository) SetRole(ctx context.Context, u *User, role Role, permissions []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.users[u.Id]
+	if !ok {
+		return ErrNotFound
+	}
+	u.Role = role
+	u.Permissions = permissions
+	stored.Role = role
+	stored.Permissions = slices.Clone(permissions)
+	r.users[u.Id] = stored
+
+	return nil
+}
+
+func (r *MemoryUserRepository) MarkVerified(ctx context.Context, u *User, at time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.users[u.Id]
+	if !ok {
+		return ErrNotFound
+	}
+	if stored.IsVerified() {
+		return ErrAlreadyVerified
+	}
+	u.VerifiedAt = at
+	stored.VerifiedAt = at
+	r.users[u.Id] = stored
+
+	return nil
+}
+
+func (r *MemoryUserRepository) UpdatePassword(ctx context.Context, u *User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.users[u.Id]
+	if !ok {
+		return ErrNotFound
+	}
+	stored.password = slices.Clone(u.password)
+	r.users[u.Id] = stored
+
+	return nil
+}
+
+func (r *MemoryUserRepository) SetTOTPSecret(ctx context.Context, u *User, encrypted []byte) error {
+	return r.update(u, func(stored *User) error {
+		stored.totp_secret = slices.Clone(encrypted)
+		stored.TOTPEnabledAt = time.Time{}
+		r.totp_steps[u.Id] = 0
+		r.recovery_codes[u.Id] = nil
+
+		u.totp_secret = encrypted
+		u.TOTPEnabledAt = time.Time{}
+		return nil
+	})
+}
+
+func (r *MemoryUserRepository) EnableTOTP(ctx context.Context, u *User, at time.Time, recovery_hashes [][]byte) error {
+	return r.update(u, func(stored *User) error {
+		if stored.totp_secret == nil || stored.HasTOTP() {
+			return ErrNoEnrollment
+		}
+		stored.TOTPEnabledAt = at
+		r.recovery_codes[u.Id] = recovery_hashes
+
+		u.TOTPEnabledAt = at
+		return nil
+	})
+}
+
+func (r *MemoryUserRepository) DisableTOTP(ctx context.Context, u *User) error {
+	return r.update(u, func(stored *User) error {
+		stored.totp_secret = nil
+		stored.TOTPEnabledAt = time.Time{}
+		r.totp_steps[u.Id] = 0
+		r.recovery_codes[u.Id] = nil
+
+		u.totp_secret = nil
+		u.TOTPEnabledAt = time.Time{}
+		return nil
+	})
+}
+
+func (r *MemoryUserRepository) UseTOTPStep(ctx context.Context, u *User, step int64) error {
+	return r.update(u, func(*User) error {
+		if r.totp_steps[u.Id] >= step {
+			return ErrInvalidCode
+		}
+		r.totp_steps[u.Id] = step
+		return nil
+	})
+}
+
+func (r *MemoryUserRepository) UseRecoveryCode(ctx context.Context, u *User, hash []byte) error {
+	return r.update(u, func(*User) error {
+		codes := r.recovery_codes[u.Id]
+		i := slices.IndexFunc(codes, func(code []byte) bool {
+			return bytes.Equal(code, hash)
+		})
+		if i < 0 {
+			return ErrInvalidCode
+		}
+		r.recovery_codes[u.Id] = slices.Delete(slices.Clone(codes), i, i+1)
+		return nil
+	})
+}
+
+// Runs f with the stored copy of the user, saving it if f succeeds.
+func (r *MemoryUserRepository) update(u *User, f func(stored *User) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.users[u.Id]
+	if !ok {
+		return ErrNotFound
+	}
+	err := f(&stored)
+	if err != nil {
+		return err
+	}
+	r.users[u.Id] = stored
+
+	return nil
+}
+
+func cloneUser(u User) *User {
+	u.Permissions = slices.Clone(u.Permissions)
+	u.password = slices.Clone(u.password)
+	u.totp_secret = slices.Clone(u.totp_secret)
+	return &u
+}
+
+type memoryPasswordReset struct {
+	user    ulid.ULID
+	expires time.Time
+}
+
+// Keeps the password reset tokens in memory, meant for tests.
+type MemoryPasswordResetRepository struct {
+	mu     sync.Mutex
+	resets map[string]memoryPasswordReset
+}
+
+func NewMemoryPasswordResetRepository() *MemoryPasswordResetRepository {
+	return &MemoryPasswordResetRepository{resets: make(map[string]memoryPasswordReset)}
+}
+
+func (r *MemoryPasswordResetRepository) Create(ctx context.Context, user ulid.ULID, token_hash []byte, expires time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.resets[string(token_hash)] = memoryPasswordReset{user: user, expires: expires}
+	return nil
+}
+
+func (r *MemoryPasswordResetRepository) Consume(ctx context.Context, token_hash []byte, now time.Time) (ulid.ULID, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	reset, ok := r.resets[string(token_hash)]
+	if !ok || !now.Before(reset.expires) {
+		return ulid.ULID{}, ErrInvalidToken
+	}
+	delete(r.resets, string(token_hash))
+
+	return reset.user, nil
+}
+
+func (r *MemoryPasswordResetRepository) DeleteForUser(ctx context.Context, user ulid.ULID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for hash, reset := range r.resets {
+		if reset.user == user {
+			delete(r.resets, hash)
+		}
+	}
+
+	return nil
+}
+
+// Keeps the login attempts in memory, meant for tests.
+type MemoryLoginAttemptRepository struct {
+	mu       sync.Mutex
+	attempts []LoginAttempt
+}
+
+func NewMemoryLoginAttemptRepository() *MemoryLoginAttemptRepository {
+	return &MemoryLoginAttemptRepository{}
+}
+
+func (r *MemoryLoginAttemptRepository) Record(ctx context.Context, a *LoginAttempt) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.attempts = append(r.attempts, *a)
+	return nil
+}
+
+// Every attempt recorded so far, oldest first.
+func (r *MemoryLoginAttemptRepository) Attempts() []LoginAttempt {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]LoginAttempt(nil), r.attempts...)
+}
+
+// Keeps the identity links in memory, meant for tests.
+type MemoryIdentityRepository struct {
+	mu         sync.Mutex
+	identities map[[2]string]UserIdentity
+}
+
+func NewMemoryIdentityRepository() *MemoryIdentityRepository {
+	return &MemoryIdentityRepository{identities: make(map[[2]string]UserIdentity)}
+}
+
+func (r *MemoryIdentityRepository) Find(ctx context.Context, provider string, subject string) (ulid.ULID, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i, ok := r.identities[[2]string{provider, subject}]
+	if !ok {
+		return ulid.ULID{}, ErrNotFound
+	}
+
+	return i.User, nil
+}
+
+func (r *MemoryIdentityRepository) Link(ctx context.Context, i *UserIdentity) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := [2]string{i.Provider, i.Subject}
+	if _, ok := r.identities[key]; ok {
+		return fmt.Errorf("identity already linked")
+	}
+	r.identities[key] = *i
+
+	return nil
+}
+
+// Hands out the memory repositories as they are, one transaction at a time.
+// They can't roll back, so a failure keeps the writes made before it, which is
+// fine for tests of the paths that succeed.
+type MemoryTransactor struct {
+	mu    sync.Mutex
+	repos TxRepositories
+}
+
+func NewMemoryTransactor(users UserRepository, resets PasswordResetRepository, identities IdentityRepository) *MemoryTransactor {
+	return &MemoryTransactor{repos: TxRepositories{Users: users, Resets: resets, Identities: identities}}
+}
+
+func (t *MemoryTransactor) WithTx(ctx context.Context, f func(repos TxRepositories) error) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return f(t.repos)
+}
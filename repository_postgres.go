@@ -0,0 +1,278 @@
+package go_template
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/oklog/ulid/v2"
+	"github.com/robertoesteves13/go-template/internal"
+	"github.com/robertoesteves13/go-template/internal/database"
+)
+
+// Both repositories accept the pool queries or the ones of a transaction, so
+// they can also be created inside `Database.WithTx`.
+type PostgresPostRepository struct {
+	db database.Querier
+}
+
+func NewPostgresPostRepository(db database.Querier) *PostgresPostRepository {
+	return &PostgresPostRepository{db: db}
+}
+
+func (r *PostgresPostRepository) Get(ctx context.Context, id ulid.ULID) (*Post, error) {
+	return GetPost(ctx, r.db, id)
+}
+
+func (r *PostgresPostRepository) List(ctx context.Context, cursor string, page_size int) (*PostsPage, error) {
+	return ListPosts(ctx, r.db, cursor, page_size)
+}
+
+func (r *PostgresPostRepository) ListByAuthor(ctx context.Context, author ulid.ULID) ([]Post, error) {
+	return ListPostsByAuthor(ctx, r.db, author)
+}
+
+func (r *PostgresPostRepository) Search(ctx context.Context, query string, limit int) ([]SearchResult, error) {
+	return SearchPosts(ctx, r.db, query, limit)
+}
+
+func (r *PostgresPostRepository) Insert(ctx context.Context, p *Post) error {
+	return p.InsertDB(ctx, r.db)
+}
+
+func (r *PostgresPostRepository) Update(ctx context.Context, p *Post) error {
+	return p.UpdateDB(ctx, r.db)
+}
+
+func (r *PostgresPostRepository) Delete(ctx context.Context, p *Post) error {
+	return p.DeleteDB(ctx, r.db)
+}
+
+type PostgresUserRepository struct {
+	db database.Querier
+}
+
+func NewPostgresUserRepository(db database.Querier) *PostgresUserRepository {
+	return &PostgresUserRepository{db: db}
+}
+
+func (r *PostgresUserRepository) Get(ctx context.Context, id ulid.ULID) (*User, error) {
+	return GetUser(ctx, r.db, id)
+}
+
+func (r *PostgresUserRepository) GetByEmail(ctx context.Context, email string) (*User, error) {
+	return UserFromDB(ctx, r.db, email)
+}
+
+func (r *PostgresUserRepository) Insert(ctx context.Context, u *User) error {
+	return u.InsertDB(ctx, r.db)
+}
+
+func (r *PostgresUserRepository) SetRole(ctx context.Context, u *User, role Role, permissions []string) error {
+	return u.SetRole(ctx, r.db, role, permissions)
+}
+
+func (r *PostgresUserRepository) MarkVerified(ctx context.Context, u *User, at time.Time) error {
+	return u.MarkVerified(ctx, r.db, at)
+}
+
+func (r *PostgresUserRepository) UpdatePassword(ctx context.Context, u *User) error {
+	return u.UpdatePasswordDB(ctx, r.db)
+}
+
+func (r *PostgresUserRepository) SetTOTPSecret(ctx context.Context, u *User, encrypted []byte) error {
+	err := r.db.SetTOTPSecret(ctx, database.SetTOTPSecretParams{
+		TotpSecret: encrypted,
+		ID:         pgtype.UUID{Bytes: u.Id, Valid: true},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set totp secret: %w", err)
+	}
+
+	u.totp_secret = encrypted
+	u.TOTPEnabledAt = time.Time{}
+	return nil
+}
+
+func (r *PostgresUserRepository) EnableTOTP(ctx context.Context, u *User, at time.Time, recovery_hashes [][]byte) error {
+	rows, err := r.db.EnableTOTP(ctx, database.EnableTOTPParams{
+		EnabledAt:     pgtype.Timestamptz{Time: at, Valid: true},
+		RecoveryCodes: recovery_hashes,
+		ID:            pgtype.UUID{Bytes: u.Id, Valid: true},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to enable totp: %w", err)
+	} else if rows == 0 {
+		return ErrNoEnrollment
+	}
+
+	u.TOTPEnabledAt = at
+	return nil
+}
+
+func (r *PostgresUserRepository) DisableTOTP(ctx context.Context, u *User) error {
+	err := r.db.DisableTOTP(ctx, pgtype.UUID{Bytes: u.Id, Valid: true})
+	if err != nil {
+		return fmt.Errorf("failed to disable totp: %w", err)
+	}
+
+	u.totp_secret = nil
+	u.TOTPEnabledAt = time.Time{}
+	return nil
+}
+
+func (r *PostgresUserRepository) UseTOTPStep(ctx context.Context, u *User, step int64) error {
+	rows, err := r.db.UseTOTPStep(ctx, database.UseTOTPStepParams{
+		Step: step,
+		ID:   pgtype.UUID{Bytes: u.Id, Valid: true},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to use totp code: %w", err)
+	} else if rows == 0 {
+		return ErrInvalidCode
+	}
+
+	return nil
+}
+
+func (r *PostgresUserRepository) UseRecoveryCode(ctx context.Context, u *User, hash []byte) error {
+	rows, err := r.db.UseRecoveryCode(ctx, database.UseRecoveryCodeParams{
+		CodeHash: hash,
+		ID:       pgtype.UUID{Bytes: u.Id, Valid: true},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to use recovery code: %w", err)
+	} else if rows == 0 {
+		return ErrInvalidCode
+	}
+
+	return nil
+}
+
+type PostgresPasswordResetRepository struct {
+	db database.Querier
+}
+
+func NewPostgresPasswordResetRepository(db database.Querier) *PostgresPasswordResetRepository {
+	return &PostgresPasswordResetRepository{db: db}
+}
+
+func (r *PostgresPasswordResetRepository) Create(ctx context.Context, user ulid.ULID, token_hash []byte, expires time.Time) error {
+	err := r.db.InsertPasswordReset(ctx, database.InsertPasswordResetParams{
+		TokenHash: token_hash,
+		UserID:    pgtype.UUID{Bytes: user, Valid: true},
+		ExpiresAt: pgtype.Timestamptz{Time: expires, Valid: true},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create password reset: %w", err)
+	}
+
+	return nil
+}
+
+func (r *PostgresPasswordResetRepository) Consume(ctx context.Context, token_hash []byte, now time.Time) (ulid.ULID, error) {
+	id, err := r.db.ConsumePasswordReset(ctx, database.ConsumePasswordResetParams{
+		TokenHash: token_hash,
+		Now:       pgtype.Timestamptz{Time: now, Valid: true},
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ulid.ULID{}, ErrInvalidToken
+	} else if err != nil {
+		return ulid.ULID{}, fmt.Errorf("failed to consume password reset: %w", err)
+	}
+
+	return id.Bytes, nil
+}
+
+func (r *PostgresPasswordResetRepository) DeleteForUser(ctx context.Context, user ulid.ULID) error {
+	err := r.db.DeletePasswordResets(ctx, pgtype.UUID{Bytes: user, Valid: true})
+	if err != nil {
+		return fmt.Errorf("failed to delete password resets: %w", err)
+	}
+
+	return nil
+}
+
+type PostgresLoginAttemptRepository struct {
+	db database.Querier
+}
+
+func NewPostgresLoginAttemptRepository(db database.Querier) *PostgresLoginAttemptRepository {
+	return &PostgresLoginAttemptRepository{db: db}
+}
+
+func (r *PostgresLoginAttemptRepository) Record(ctx context.Context, a *LoginAttempt) error {
+	err := r.db.InsertLoginAttempt(ctx, database.InsertLoginAttemptParams{
+		UserID:    pgtype.UUID{Bytes: a.User, Valid: a.User != ulid.ULID{}},
+		Email:     a.Email,
+		Ip:        a.IP,
+		Succeeded: a.Succeeded,
+		Reason:    string(a.Reason),
+		CreatedAt: pgtype.Timestamptz{Time: a.At, Valid: true},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record login attempt: %w", err)
+	}
+
+	return nil
+}
+
+type PostgresIdentityRepository struct {
+	db database.Querier
+}
+
+func NewPostgresIdentityRepository(db database.Querier) *PostgresIdentityRepository {
+	return &PostgresIdentityRepository{db: db}
+}
+
+func (r *PostgresIdentityRepository) Find(ctx context.Context, provider string, subject string) (ulid.ULID, error) {
+	id, err := r.db.GetUserIdentity(ctx, database.GetUserIdentityParams{
+		Provider: provider,
+		Subject:  subject,
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ulid.ULID{}, ErrNotFound
+	} else if err != nil {
+		return ulid.ULID{}, fmt.Errorf("failed to get identity: %w", err)
+	}
+
+	return id.Bytes, nil
+}
+
+func (r *PostgresIdentityRepository) Link(ctx context.Context, i *UserIdentity) error {
+	err := r.db.InsertUserIdentity(ctx, database.InsertUserIdentityParams{
+		Provider:  i.Provider,
+		Subject:   i.Subject,
+		UserID:    pgtype.UUID{Bytes: i.User, Valid: true},
+		Email:     i.Email,
+		CreatedAt: pgtype.Timestamptz{Time: i.CreatedAt, Valid: true},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to link identity: %w", err)
+	}
+
+	return nil
+}
+
+// Runs the transactions with Database.WithTx, handing out the postgres
+// repositories created on its queries.
+type PostgresTransactor struct {
+	db *internal.Database
+}
+
+func NewPostgresTransactor(db *internal.Database) *PostgresTransactor {
+	return &PostgresTransactor{db: db}
+}
+
+func (t *PostgresTransactor) WithTx(ctx context.Context, f func(repos TxRepositories) error) error {
+	return t.db.WithTx(ctx, func(q *database.Queries) error {
+		return f(TxRepositories{
+			Users:      NewPostgresUserRepository(q),
+			Resets:     NewPostgresPasswordResetRepository(q),
+			Identities: NewPostgresIdentityRepository(q),
+		})
+	})
+}
@@ -0,0 +1,45 @@
+package go_template
+
+import "slices"
+
+// Role of an user, which grants a fixed set of permissions. Extra permissions
+// can be granted per user with User.Permissions.
+type Role string
+
+const (
+	RoleUser  Role = "user"
+	RoleAdmin Role = "admin"
+)
+
+// Permissions follow the `resource:action` format, so they can be checked by
+// the authorization middleware without knowing about the domain.
+const (
+	PermissionPostWrite  = "post:write"
+	PermissionPostEdit   = "post:edit"
+	PermissionPostDelete = "post:delete"
+	PermissionUserManage = "user:manage"
+)
+
+var rolePermissions = map[Role][]string{
+	RoleUser: {
+		PermissionPostWrite,
+	},
+	RoleAdmin: {
+		PermissionPostWrite,
+		PermissionPostEdit,
+		PermissionPostDelete,
+		PermissionUserManage,
+	},
+}
+
+// Reports if the user has the permission, either from its role or granted
+// directly. Users that didn't verify their email have none, they can only
+// browse the site while logged in.
+func (u *User) HasPermission(permission string) bool {
+	if !u.IsVerified() {
+		return false
+	}
+
+	return slices.Contains(rolePermissions[u.Role], permission) ||
+		slices.Contains(u.Permissions, permission)
+}
@@ -0,0 +1,94 @@
+package go_template
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/robertoesteves13/go-template/internal/database"
+)
+
+// Markers used by SearchPosts around each match in the headline.
+const (
+	headlineStart = "⟦"
+	headlineStop  = "⟧"
+)
+
+// Piece of a search headline. Highlighted spans are the words that matched
+// the query.
+type TextSpan struct {
+	Text      string
+	Highlight bool
+}
+
+type SearchResult struct {
+	Post     Post
+	Rank     float32
+	Headline []TextSpan
+}
+
+// Searches the title, subtitle and content of the posts. The query accepts the
+// same syntax as web search engines, such as quoted phrases and `-word`.
+// Results are ordered by relevance.
+func SearchPosts(ctx context.Context, db database.Querier, query string, limit int) ([]SearchResult, error) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return []SearchResult{}, nil
+	}
+
+	rows, err := db.SearchPosts(ctx, database.SearchPostsParams{
+		Query:    query,
+		PageSize: int32(limit),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to search posts: %w", err)
+	}
+
+	results := make([]SearchResult, 0, len(rows))
+	for _, row := range rows {
+		post := PostFromDB(database.ListPostsRow{
+			ID:         row.ID,
+			Title:      row.Title,
+			Subtitle:   row.Subtitle,
+			Content:    row.Content,
+			CreatedAt:  row.CreatedAt,
+			UpdatedAt:  row.UpdatedAt,
+			AuthorID:   row.AuthorID,
+			AuthorName: row.AuthorName,
+		})
+
+		results = append(results, SearchResult{
+			Post:     *post,
+			Rank:     row.Rank,
+			Headline: splitHeadline(row.Headline),
+		})
+	}
+
+	return results, nil
+}
+
+// Splits the headline on the markers, so templates can highlight the matches
+// without trusting the post content as HTML.
+func splitHeadline(headline string) []TextSpan {
+	spans := make([]TextSpan, 0)
+	for headline != "" {
+		start := strings.Index(headline, headlineStart)
+		if start < 0 {
+			spans = append(spans, TextSpan{Text: headline})
+			break
+		}
+		if start > 0 {
+			spans = append(spans, TextSpan{Text: headline[:start]})
+		}
+		headline = headline[start+len(headlineStart):]
+
+		stop := strings.Index(headline, headlineStop)
+		if stop < 0 {
+			stop = len(headline)
+		}
+		spans = append(spans, TextSpan{Text: headline[:stop], Highlight: true})
+		headline = strings.TrimPrefix(headline[stop:], headlineStop)
+	}
+
+	return spans
+}
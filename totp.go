@@ -0,0 +1,222 @@
+package go_template
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidCode = errors.New("invalid code")
+	// Returned when confirming an enrollment that was never started.
+	ErrNoEnrollment = errors.New("two-factor enrollment not started")
+)
+
+// RFC 6238 defaults, the only ones most authenticator apps support.
+const (
+	totpPeriod        = 30
+	totpDigits        = 6
+	totpSecretSize    = 20
+	recoveryCodeCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Two-factor authentication with TOTP authenticator apps. The secrets are
+// encrypted with AES-GCM before reaching the repository, and recovery codes
+// are only stored as hashes.
+type TwoFactor struct {
+	users  UserRepository
+	aead   cipher.AEAD
+	issuer string
+}
+
+// The key must have 32 bytes and be kept between restarts, otherwise enrolled
+// users can only login with their recovery codes. The issuer is the name
+// shown by the authenticator app.
+func NewTwoFactor(users UserRepository, key []byte, issuer string) (*TwoFactor, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("totp key must have 32 bytes, got %d", len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+
+	return &TwoFactor{users: users, aead: aead, issuer: issuer}, nil
+}
+
+// Generates a new secret for the user, which only takes effect after being
+// confirmed with ConfirmEnrollment. Starting again replaces the secret, and
+// disables two-factor authentication if it was enabled.
+func (tf *TwoFactor) BeginEnrollment(ctx context.Context, u *User) error {
+	secret := make([]byte, totpSecretSize)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return fmt.Errorf("failed to generate secret: %v", err)
+	}
+
+	return tf.users.SetTOTPSecret(ctx, u, tf.encrypt(u, secret))
+}
+
+// The `otpauth://` URI of the pending enrollment, which authenticator apps
+// read from a QR code. Returns ErrNoEnrollment if there's none.
+func (tf *TwoFactor) EnrollmentURI(u *User) (string, error) {
+	if u.HasTOTP() || u.totp_secret == nil {
+		return "", ErrNoEnrollment
+	}
+
+	secret, err := tf.decrypt(u)
+	if err != nil {
+		return "", err
+	}
+
+	label := url.PathEscape(tf.issuer + ":" + u.Email)
+	params := url.Values{
+		"secret":    {totpEncoding.EncodeToString(secret)},
+		"issuer":    {tf.issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+
+	return "otpauth://totp/" + label + "?" + params.Encode(), nil
+}
+
+// Enables two-factor authentication once the user proves the app works by
+// sending a code from it. Returns the recovery codes, which must be shown to
+// the user since they can't be recovered later.
+func (tf *TwoFactor) ConfirmEnrollment(ctx context.Context, u *User, code string, now time.Time) ([]string, error) {
+	if u.HasTOTP() || u.totp_secret == nil {
+		return nil, ErrNoEnrollment
+	}
+
+	err := tf.verifyTOTP(ctx, u, code, now)
+	if err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([][]byte, 0, recoveryCodeCount)
+	for range recoveryCodeCount {
+		b := make([]byte, 10)
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate recovery code: %v", err)
+		}
+
+		code := totpEncoding.EncodeToString(b)
+		codes = append(codes, code[0:4]+"-"+code[4:8]+"-"+code[8:12]+"-"+code[12:16])
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+
+	err = tf.users.EnableTOTP(ctx, u, now, hashes)
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+func (tf *TwoFactor) Disable(ctx context.Context, u *User) error {
+	return tf.users.DisableTOTP(ctx, u)
+}
+
+// Checks a code from the authenticator app or one of the recovery codes,
+// returning ErrInvalidCode if it's wrong or was already used.
+func (tf *TwoFactor) Verify(ctx context.Context, u *User, code string, now time.Time) error {
+	if !u.HasTOTP() {
+		return ErrInvalidCode
+	}
+
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) == totpDigits {
+		return tf.verifyTOTP(ctx, u, code, now)
+	}
+
+	normalized := strings.ToUpper(strings.ReplaceAll(code, "-", ""))
+	return tf.users.UseRecoveryCode(ctx, u, hashRecoveryCode(normalized))
+}
+
+// Accepts the codes of the previous and next periods too, since the clocks of
+// the phone and the server are never exactly the same. The step is recorded
+// so the same code can't be used again.
+func (tf *TwoFactor) verifyTOTP(ctx context.Context, u *User, code string, now time.Time) error {
+	secret, err := tf.decrypt(u)
+	if err != nil {
+		return err
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - 1; step <= current+1; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return tf.users.UseTOTPStep(ctx, u, step)
+		}
+	}
+
+	return ErrInvalidCode
+}
+
+// The id of the user is authenticated with the secret, so a secret can't be
+// copied to another user.
+func (tf *TwoFactor) encrypt(u *User, secret []byte) []byte {
+	nonce := make([]byte, tf.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		panic("unreachable error on totp.go: " + err.Error())
+	}
+
+	return tf.aead.Seal(nonce, nonce, secret, u.Id[:])
+}
+
+func (tf *TwoFactor) decrypt(u *User) ([]byte, error) {
+	size := tf.aead.NonceSize()
+	if len(u.totp_secret) < size {
+		return nil, fmt.Errorf("invalid totp secret")
+	}
+
+	secret, err := tf.aead.Open(nil, u.totp_secret[:size], u.totp_secret[size:], u.Id[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt totp secret: %v", err)
+	}
+
+	return secret, nil
+}
+
+// RFC 4226 HOTP of the time step.
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%1_000_000)
+}
+
+// Recovery codes are random, so a plain hash is enough.
+func hashRecoveryCode(code string) []byte {
+	hash := sha256.Sum256([]byte(code))
+	return hash[:]
+}
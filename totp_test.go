@@ -0,0 +1,95 @@
+package go_template
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// RFC 6238 appendix B, SHA-1. The vectors have 8 digits, the last 6 are the
+// code of the same step.
+func TestTOTPCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	vectors := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+
+	for _, v := range vectors {
+		got := totpCode(secret, v.unix/totpPeriod)
+		if want := v.code[len(v.code)-totpDigits:]; got != want {
+			t.Errorf("code at %d is %s, want %s", v.unix, got, want)
+		}
+	}
+}
+
+func TestTwoFactorVerify(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1_700_000_010, 0)
+	step := now.Unix() / totpPeriod
+
+	users := NewMemoryUserRepository()
+	user := &User{Id: ulid.Make(), Name: "alice", Email: "alice@example.com", Role: RoleUser}
+	err := users.Insert(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tf, err := NewTwoFactor(users, make([]byte, 32), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tf.BeginEnrollment(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := tf.decrypt(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The clock of the phone may be a step behind.
+	recovery, err := tf.ConfirmEnrollment(ctx, user, totpCode(secret, step-1), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recovery) != recoveryCodeCount {
+		t.Fatalf("got %d recovery codes, want %d", len(recovery), recoveryCodeCount)
+	}
+
+	cases := []struct {
+		name  string
+		code  string
+		valid bool
+	}{
+		{"replayed code", totpCode(secret, step-1), false},
+		{"two steps behind", totpCode(secret, step-2), false},
+		{"two steps ahead", totpCode(secret, step+2), false},
+		{"one step ahead", totpCode(secret, step+1), true},
+		// Older than the last code used, even though it's in the window.
+		{"current step after a newer one", totpCode(secret, step), false},
+		{"recovery code", strings.ToLower(recovery[0]), true},
+		{"used recovery code", recovery[0], false},
+		{"recovery code without dashes", strings.ReplaceAll(recovery[1], "-", ""), true},
+		{"wrong recovery code", "AAAA-AAAA-AAAA-AAAA", false},
+	}
+	for _, c := range cases {
+		err := tf.Verify(ctx, user, c.code, now)
+		if c.valid && err != nil {
+			t.Errorf("%s got %v, want it accepted", c.name, err)
+		} else if !c.valid && !errors.Is(err, ErrInvalidCode) {
+			t.Errorf("%s got %v, want ErrInvalidCode", c.name, err)
+		}
+	}
+}
@@ -2,65 +2,305 @@ package go_template
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+	"unicode/utf8"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgtype"
-	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/oklog/ulid/v2"
 	"github.com/robertoesteves13/go-template/internal/database"
-	"golang.org/x/crypto/bcrypt"
 )
 
 type User struct {
-	Id       ulid.ULID
-	Name     string
-	Email    string
-	password []byte
+	Id          ulid.ULID
+	Name        string
+	Email       string
+	Role        Role
+	Permissions []string
+	// Zero until the user opens the link sent to their email.
+	VerifiedAt time.Time
+	// Zero unless two-factor authentication is enabled.
+	TOTPEnabledAt time.Time
+	password      []byte
+	// Encrypted, see TwoFactor. It's set while enrolling too.
+	totp_secret []byte
 }
 
-func NewUser(name string, email string, password string) (*User, error) {
-	hashed, err := bcrypt.GenerateFromPassword([]byte(password), 14)
+const (
+	minUsernameLength = 3
+	maxUsernameLength = 32
+	maxEmailLength    = 254
+	minPasswordLength = 8
+	maxPasswordLength = 128
+)
+
+// Passwords that show up first on every leaked list, refused no matter how
+// long they are.
+var commonPasswords = map[string]bool{
+	"password": true, "password1": true, "password123": true, "12345678": true,
+	"123456789": true, "1234567890": true, "qwertyuiop": true, "iloveyou": true,
+	"sunshine": true, "princess": true, "football": true, "baseball": true,
+	"welcome1": true, "superman": true, "trustno1": true, "letmein1": true,
+	"11111111": true, "00000000": true, "abcdefgh": true, "qwerty123": true,
+}
+
+// Checks the fields of a new account before anything is hashed, returning
+// ValidationErrors keyed by the fields of the register form.
+func ValidateRegistration(hasher PasswordHasher, name string, email string, password string) error {
+	errs := ValidationErrors{}
+	if msg := validateUsername(name); msg != "" {
+		errs["username"] = msg
+	}
+	if msg := validateEmail(email); msg != "" {
+		errs["email"] = msg
+	}
+	if msg := validatePassword(hasher, password, name, email); msg != "" {
+		errs["password"] = msg
+	}
+
+	return errs.OrNil()
+}
+
+func validateUsername(name string) string {
+	length := utf8.RuneCountInString(name)
+	if length < minUsernameLength || length > maxUsernameLength {
+		return fmt.Sprintf("Username must have between %d and %d characters", minUsernameLength, maxUsernameLength)
+	}
+
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.') {
+			return "Username can only have letters, numbers, dots, dashes and underscores"
+		}
+	}
+
+	return ""
+}
+
+func validateEmail(email string) string {
+	if email == "" {
+		return "Email is required"
+	} else if len(email) > maxEmailLength {
+		return fmt.Sprintf("Email must have at most %d characters", maxEmailLength)
+	}
+
+	// ParseAddress also accepts `Name <address>`, only the bare address is
+	// wanted here.
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || !strings.Contains(email[strings.LastIndex(email, "@"):], ".") {
+		return "Email is not valid"
+	}
+
+	return ""
+}
+
+// The name and email of the user are needed so the password can't be one of
+// them. The limit of the hasher is checked here too, so a password it would
+// refuse fails before anything is written.
+func validatePassword(hasher PasswordHasher, password string, name string, email string) string {
+	length := utf8.RuneCountInString(password)
+	lower := strings.ToLower(password)
+	local, _, _ := strings.Cut(strings.ToLower(email), "@")
+
+	switch {
+	case length < minPasswordLength:
+		return fmt.Sprintf("Password must have at least %d characters", minPasswordLength)
+	case length > maxPasswordLength:
+		return fmt.Sprintf("Password must have at most %d characters", maxPasswordLength)
+	case hasher.MaxPasswordBytes() > 0 && len(password) > hasher.MaxPasswordBytes():
+		return fmt.Sprintf("Password must have at most %d bytes", hasher.MaxPasswordBytes())
+	case commonPasswords[lower]:
+		return "Password is too common"
+	case name != "" && strings.Contains(lower, strings.ToLower(name)),
+		local != "" && strings.Contains(lower, local):
+		return "Password can't contain your username or email"
+	}
+
+	return ""
+}
+
+// Returns ValidationErrors when the fields aren't acceptable, see
+// ValidateRegistration.
+func NewUser(name string, email string, password string, hasher PasswordHasher) (*User, error) {
+	err := ValidateRegistration(hasher, name, email, password)
+	if err != nil {
+		return nil, err
+	}
+
+	hashed, err := hasher.Hash(password)
 	if err != nil {
-		return nil, fmt.Errorf("failed to hash password: %v", err)
+		return nil, err
 	}
 
 	return &User{
 		Id:       ulid.Make(),
 		Name:     name,
 		Email:    email,
+		Role:     RoleUser,
 		password: hashed,
 	}, nil
 }
 
-func (u *User) ValidatePassword(password string) bool {
-	err := bcrypt.CompareHashAndPassword(u.password, []byte(password))
-	return err == nil
+func (u *User) IsVerified() bool {
+	return !u.VerifiedAt.IsZero()
 }
 
-func UserFromDB(ctx context.Context, conn *pgxpool.Conn, email string) (*User, error) {
-	db := database.New(conn)
-	dbusr, err := db.GetUserByEmail(ctx, pgtype.Text{String: email, Valid: true})
+func (u *User) HasTOTP() bool {
+	return !u.TOTPEnabledAt.IsZero()
+}
+
+// Used by the session manager to ask for the second step on login.
+func (u *User) RequiresSecondFactor() bool {
+	return u.HasTOTP()
+}
+
+// Checks the password of the user. When it's right but the hash is outdated,
+// it's replaced by a new one from the hasher and saved on the repository. A
+// failed rehash is returned as an error together with ok, since the password
+// is still right.
+func (u *User) ValidatePassword(ctx context.Context, users UserRepository, hasher PasswordHasher, password string) (ok bool, err error) {
+	ok, err = verifyPassword(u.password, password)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	if hasher.NeedsRehash(u.password) {
+		err = u.SetPassword(hasher, password)
+		if err == nil {
+			err = users.UpdatePassword(ctx, u)
+		}
+		if err != nil {
+			return true, fmt.Errorf("failed to rehash password: %w", err)
+		}
+	}
+
+	return true, nil
+}
+
+// Changes the password in memory, save it with UpdatePasswordDB.
+func (u *User) SetPassword(hasher PasswordHasher, password string) error {
+	hashed, err := hasher.Hash(password)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get user: %v", err)
+		return err
 	}
 
-	user := &User{
-		Id:       dbusr.ID.Bytes,
-		Name:     dbusr.Name.String,
-		Email:    dbusr.Email.String,
-		password: dbusr.Password,
+	u.password = hashed
+	return nil
+}
+
+// Gets an user by its email, returning ErrNotFound if it doesn't exist.
+func UserFromDB(ctx context.Context, db database.Querier, email string) (*User, error) {
+	dbusr, err := db.GetUserByEmail(ctx, pgtype.Text{String: email, Valid: true})
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
 	}
 
-	return user, nil
+	return userFromRow(dbusr), nil
 }
 
-func (u *User) InsertDB(ctx context.Context, conn *pgxpool.Conn) error {
-	db := database.New(conn)
+// Gets an user by its id, returning ErrNotFound if it doesn't exist.
+func GetUser(ctx context.Context, db database.Querier, id ulid.ULID) (*User, error) {
+	dbusr, err := db.GetUserByID(ctx, pgtype.UUID{Bytes: id, Valid: true})
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+
+	return userFromRow(dbusr), nil
+}
 
-	return db.InsertUser(ctx, database.InsertUserParams{
-		ID:        pgtype.UUID{Bytes: u.Id, Valid: true},
-		Name:     pgtype.Text{String: u.Name, Valid: true},
-		Email:  pgtype.Text{String: u.Email, Valid: true},
-		Password:   u.password,
+func userFromRow(dbusr database.User) *User {
+	return &User{
+		Id:            dbusr.ID.Bytes,
+		Name:          dbusr.Name.String,
+		Email:         dbusr.Email.String,
+		Role:          Role(dbusr.Role),
+		Permissions:   dbusr.Permissions,
+		VerifiedAt:    dbusr.VerifiedAt.Time,
+		TOTPEnabledAt: dbusr.TotpEnabledAt.Time,
+		password:      dbusr.Password,
+		totp_secret:   dbusr.TotpSecret,
+	}
+}
+
+// Public page with the posts of the user.
+func (u *User) URL() string {
+	return fmt.Sprintf("/user/%s", u.Id)
+}
+
+// SQLSTATE of a duplicate key.
+const uniqueViolation = "23505"
+
+// Returns ValidationErrors when the email is already registered.
+func (u *User) InsertDB(ctx context.Context, db database.Querier) error {
+	err := db.InsertUser(ctx, database.InsertUserParams{
+		ID:          pgtype.UUID{Bytes: u.Id, Valid: true},
+		Name:        pgtype.Text{String: u.Name, Valid: true},
+		Email:       pgtype.Text{String: u.Email, Valid: true},
+		Password:    u.password,
+		Role:        string(u.Role),
+		Permissions: u.permissions(),
 	})
+
+	var pg_err *pgconn.PgError
+	if errors.As(err, &pg_err) && pg_err.Code == uniqueViolation && pg_err.ConstraintName == "users_email_key" {
+		return ValidationErrors{"email": "Email is already registered"}
+	} else if err != nil {
+		return fmt.Errorf("failed to insert user: %w", err)
+	}
+
+	return nil
+}
+
+func (u *User) UpdatePasswordDB(ctx context.Context, db database.Querier) error {
+	return db.UpdateUserPassword(ctx, database.UpdateUserPasswordParams{
+		Password: u.password,
+		ID:       pgtype.UUID{Bytes: u.Id, Valid: true},
+	})
+}
+
+// Changes the role and the extra permissions of the user. The sessions of the
+// user keep the old ones until they are rotated or revoked.
+func (u *User) SetRole(ctx context.Context, db database.Querier, role Role, permissions []string) error {
+	u.Role = role
+	u.Permissions = permissions
+
+	return db.UpdateUserRole(ctx, database.UpdateUserRoleParams{
+		Role:        string(u.Role),
+		Permissions: u.permissions(),
+		ID:          pgtype.UUID{Bytes: u.Id, Valid: true},
+	})
+}
+
+// Marks the email of the user as verified. Returns ErrAlreadyVerified if it
+// already was, so the same link can't be used twice.
+func (u *User) MarkVerified(ctx context.Context, db database.Querier, at time.Time) error {
+	rows, err := db.VerifyUser(ctx, database.VerifyUserParams{
+		VerifiedAt: pgtype.Timestamptz{Time: at, Valid: true},
+		ID:         pgtype.UUID{Bytes: u.Id, Valid: true},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to verify user: %w", err)
+	} else if rows == 0 {
+		return ErrAlreadyVerified
+	}
+
+	u.VerifiedAt = at
+	return nil
+}
+
+// The column is NOT NULL, so a nil slice must become an empty array.
+func (u *User) permissions() []string {
+	if u.Permissions == nil {
+		return []string{}
+	}
+
+	return u.Permissions
 }
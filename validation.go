@@ -0,0 +1,43 @@
+package go_template
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+var (
+	// Returned when the requested entity doesn't exist.
+	ErrNotFound = errors.New("not found")
+	// Returned when the user isn't allowed to do what was asked.
+	ErrForbidden = errors.New("forbidden")
+)
+
+// Errors found while validating an input, keyed by the name of the field.
+// Handlers can show each message next to its field when re-rendering a form.
+type ValidationErrors map[string]string
+
+func (ve ValidationErrors) Error() string {
+	fields := make([]string, 0, len(ve))
+	for field := range ve {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	msgs := make([]string, 0, len(fields))
+	for _, field := range fields {
+		msgs = append(msgs, field+": "+ve[field])
+	}
+
+	return "invalid input: " + strings.Join(msgs, ", ")
+}
+
+// Returns nil when there are no errors, so it can be returned directly as an
+// error without becoming a non-nil interface holding an empty map.
+func (ve ValidationErrors) OrNil() error {
+	if len(ve) == 0 {
+		return nil
+	}
+
+	return ve
+}
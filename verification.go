@@ -0,0 +1,96 @@
+package go_template
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+var (
+	ErrInvalidToken    = errors.New("invalid token")
+	ErrTokenExpired    = errors.New("token expired")
+	ErrAlreadyVerified = errors.New("email already verified")
+)
+
+// Creates and checks the tokens sent by email to verify the address of an
+// user. Tokens are signed instead of stored: they carry the user id and the
+// expiry, and the signature also covers the email, so changing the address
+// invalidates old links. They work once because verifying an user that is
+// already verified fails.
+type EmailVerifier struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+// The secret must be kept between restarts, otherwise the links already sent
+// stop working.
+func NewEmailVerifier(secret []byte, ttl time.Duration) *EmailVerifier {
+	return &EmailVerifier{secret: secret, ttl: ttl}
+}
+
+// Token for the verification link of the user.
+func (v *EmailVerifier) Token(u *User, now time.Time) string {
+	payload := make([]byte, len(u.Id)+8)
+	copy(payload, u.Id[:])
+	binary.BigEndian.PutUint64(payload[len(u.Id):], uint64(now.Add(v.ttl).Unix()))
+
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(v.sign(payload, u.Email))
+}
+
+// Checks the token and marks the user as verified, returning the user.
+func (v *EmailVerifier) Verify(ctx context.Context, users UserRepository, token string, now time.Time) (*User, error) {
+	encoded_payload, encoded_sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded_payload)
+	if err != nil || len(payload) != len(ulid.ULID{})+8 {
+		return nil, ErrInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encoded_sig)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	var id ulid.ULID
+	copy(id[:], payload)
+	user, err := users.Get(ctx, id)
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrInvalidToken
+	} else if err != nil {
+		return nil, err
+	}
+
+	if !hmac.Equal(sig, v.sign(payload, user.Email)) {
+		return nil, ErrInvalidToken
+	}
+	if user.IsVerified() {
+		return nil, ErrAlreadyVerified
+	}
+	expires := time.Unix(int64(binary.BigEndian.Uint64(payload[len(id):])), 0)
+	if now.After(expires) {
+		return nil, ErrTokenExpired
+	}
+
+	err = users.MarkVerified(ctx, user, now)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (v *EmailVerifier) sign(payload []byte, email string) []byte {
+	mac := hmac.New(sha256.New, v.secret)
+	mac.Write(payload)
+	mac.Write([]byte(email))
+	return mac.Sum(nil)
+}
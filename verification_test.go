@@ -0,0 +1,89 @@
+package go_template
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestEmailVerifier(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	hasher, err := NewBcryptHasher(bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users := NewMemoryUserRepository()
+	user, err := NewUser("alice", "alice@example.com", "correct horse battery", hasher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = users.Insert(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier := NewEmailVerifier([]byte("secret"), time.Hour)
+	token := verifier.Token(user, now)
+	payload, sig, _ := strings.Cut(token, ".")
+
+	// A later expiry with the old signature.
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.BigEndian.PutUint64(raw[len(user.Id):], uint64(now.Add(24*time.Hour).Unix()))
+	extended := base64.RawURLEncoding.EncodeToString(raw) + "." + sig
+
+	// Issued while the user had another email.
+	old := *user
+	old.Email = "old@example.com"
+
+	cases := []struct {
+		name  string
+		token string
+		now   time.Time
+		want  error
+	}{
+		{"tampered signature", payload + "." + strings.Repeat("A", len(sig)), now, ErrInvalidToken},
+		{"tampered expiry", extended, now, ErrInvalidToken},
+		{"other secret", NewEmailVerifier([]byte("other"), time.Hour).Token(user, now), now, ErrInvalidToken},
+		{"changed email", verifier.Token(&old, now), now, ErrInvalidToken},
+		{"expired token", token, now.Add(time.Hour + time.Second), ErrTokenExpired},
+		{"malformed token", "not a token", now, ErrInvalidToken},
+	}
+	for _, c := range cases {
+		_, err := verifier.Verify(ctx, users, c.token, c.now)
+		if !errors.Is(err, c.want) {
+			t.Errorf("%s got %v, want %v", c.name, err, c.want)
+		}
+	}
+
+	saved, err := users.Get(ctx, user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.IsVerified() {
+		t.Fatal("user verified by a refused token")
+	}
+
+	verified, err := verifier.Verify(ctx, users, token, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verified.Id != user.Id || !verified.IsVerified() {
+		t.Errorf("got %+v, want alice verified", verified)
+	}
+
+	_, err = verifier.Verify(ctx, users, token, now)
+	if !errors.Is(err, ErrAlreadyVerified) {
+		t.Errorf("second use got %v, want ErrAlreadyVerified", err)
+	}
+}